@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// The API rejects requests with more cache breakpoints than this.
+const maxCacheBreakpoints = 4
+
+// Beta needed for the 1 hour cache TTL.
+const extendedCacheTTLBeta = "extended-cache-ttl-2025-04-11"
+
+// Values for the per-breakpoint TTL settings.
+const (
+	cacheTTL5m   = "5m"
+	cacheTTL1h   = "1h"
+	cacheTTLAuto = "auto"
+)
+
+// alterCacheControl places cache breakpoints on the last tool and on the
+// conversation history, within the API's limit of four per request.
+//
+// The system prompt breakpoint set by setSystemPrompt is kept. Message
+// breakpoints go on the last user turn, so the whole conversation so far is
+// written to the cache, and on earlier user turns snapped to every
+// stable_interval messages. The snapped turns stay put for several requests
+// in a row, so each request can read most of the history back from the cache
+// even after the last-turn breakpoint has moved on.
+func alterCacheControl(tc *transformContext) bool {
+	params := tc.params
+	cfg := tc.transforms.CacheControl
+
+	var modified bool
+	if cfg.Messages > 0 {
+		// We place message breakpoints ourselves.
+		if n := stripMessageBreakpoints(params.Messages); n > 0 {
+			tc.notef("removed %d client message breakpoints", n)
+			modified = true
+		}
+	}
+
+	var idled bool
+	if info, ok := getRequestInfoFromContext(tc.request.Context()); ok {
+		idled = observeSessionActivity(info.session, time.Now(), cfg.TTL.IdleThreshold)
+	}
+	toolsTTL, systemTTL, messagesTTL := cfg.TTL.resolve(idled)
+
+	if cfg.Tools && len(params.Tools) > 0 {
+		lastTool := params.Tools[len(params.Tools)-1]
+		if cacheControl := lastTool.GetCacheControl(); cacheControl != nil {
+			*cacheControl = newCacheControl(toolsTTL)
+			tc.notef("cache breakpoint set on tool '%s'%s", *lastTool.GetName(), ttlNote(toolsTTL))
+			modified = true
+		}
+	}
+
+	for i := range params.System {
+		if cc := &params.System[i].CacheControl; isCacheBreakpoint(cc) && cc.TTL != systemTTL {
+			cc.TTL = systemTTL
+			tc.notef("system block %d cache TTL set to %s", i, ttlName(systemTTL))
+			modified = true
+		}
+	}
+
+	budget := maxCacheBreakpoints - len(cacheBreakpoints(params))
+	for _, idx := range messageBreakpointTargets(params.Messages, cfg) {
+		if budget <= 0 {
+			break
+		}
+		if markMessage(params.Messages[idx], messagesTTL) {
+			tc.notef("cache breakpoint set on message %d%s", idx, ttlNote(messagesTTL))
+			budget--
+			modified = true
+		}
+	}
+
+	if n := enforceBreakpointLimit(params); n > 0 {
+		tc.notef("removed %d breakpoints over the limit of %d", n, maxCacheBreakpoints)
+		modified = true
+	}
+
+	if usesExtendedTTL(params) && addBetaHeader(tc.request.Header, extendedCacheTTLBeta) {
+		tc.notef("added %s beta header", extendedCacheTTLBeta)
+		modified = true
+	}
+
+	return modified
+}
+
+// CacheTTLConfig sets the TTL of each kind of breakpoint: "5m", "1h" or
+// "auto". Auto uses the 1 hour TTL after the session has been idle for longer
+// than IdleThreshold, i.e. the user stepped away long enough for 5 minute
+// cache entries to expire, until idleDecayRequests requests in a row have
+// followed each other more closely than that.
+type CacheTTLConfig struct {
+	Tools         string        `yaml:"tools"`
+	System        string        `yaml:"system"`
+	Messages      string        `yaml:"messages"`
+	IdleThreshold time.Duration `yaml:"idle_threshold"`
+}
+
+func (c CacheTTLConfig) validate() error {
+	for _, ttl := range []string{c.Tools, c.System, c.Messages} {
+		switch ttl {
+		case cacheTTL5m, cacheTTL1h, cacheTTLAuto:
+		default:
+			return fmt.Errorf("invalid cache TTL %q, must be 5m, 1h or auto", ttl)
+		}
+	}
+	return nil
+}
+
+// resolve returns the TTLs to use for tools, system and messages. The API
+// requires longer TTLs to come before shorter ones, and tools come before the
+// system prompt which comes before messages, so later TTLs are capped by
+// earlier ones being raised.
+func (c CacheTTLConfig) resolve(idled bool) (tools, system, messages anthropic.BetaCacheControlEphemeralTTL) {
+	pick := func(ttl string) anthropic.BetaCacheControlEphemeralTTL {
+		if ttl == cacheTTL1h || (ttl == cacheTTLAuto && idled) {
+			return anthropic.BetaCacheControlEphemeralTTLTTL1h
+		}
+		// Leaving it empty gives the default 5 minutes.
+		return ""
+	}
+	tools, system, messages = pick(c.Tools), pick(c.System), pick(c.Messages)
+	if messages != "" {
+		system = messages
+	}
+	if system != "" {
+		tools = system
+	}
+	return tools, system, messages
+}
+
+func newCacheControl(ttl anthropic.BetaCacheControlEphemeralTTL) anthropic.BetaCacheControlEphemeralParam {
+	cc := anthropic.NewBetaCacheControlEphemeralParam()
+	cc.TTL = ttl
+	return cc
+}
+
+func ttlName(ttl anthropic.BetaCacheControlEphemeralTTL) string {
+	if ttl == "" {
+		return cacheTTL5m
+	}
+	return string(ttl)
+}
+
+func ttlNote(ttl anthropic.BetaCacheControlEphemeralTTL) string {
+	if ttl == "" {
+		return ""
+	}
+	return " (ttl " + string(ttl) + ")"
+}
+
+func usesExtendedTTL(params *anthropic.BetaMessageNewParams) bool {
+	for _, cc := range cacheBreakpoints(params) {
+		if cc.TTL == anthropic.BetaCacheControlEphemeralTTLTTL1h {
+			return true
+		}
+	}
+	return false
+}
+
+// addBetaHeader adds beta to the anthropic-beta header unless it is already
+// there, and reports whether it was added.
+func addBetaHeader(header http.Header, beta string) bool {
+	existing := header.Get("anthropic-beta")
+	for _, b := range strings.Split(existing, ",") {
+		if strings.TrimSpace(b) == beta {
+			return false
+		}
+	}
+	if existing != "" {
+		beta = existing + "," + beta
+	}
+	header.Set("anthropic-beta", beta)
+	return true
+}
+
+// Sessions idle for longer than the longest cache TTL have nothing cached
+// anymore. They are forgotten, checking at most every sessionSweepInterval,
+// and start over as new sessions if they come back.
+const (
+	sessionRetention     = time.Hour
+	sessionSweepInterval = time.Minute
+)
+
+// A session that went idle no longer counts as idle once this many requests
+// in a row came within the idle threshold of each other.
+const idleDecayRequests = 20
+
+// sessionActivity remembers when each session was last seen and, for
+// sessions that went idle, how many more busy requests it takes until they
+// no longer count as idle.
+var sessionActivity = struct {
+	sync.Mutex
+	lastSeen  map[string]time.Time
+	idled     map[string]int
+	lastSweep time.Time
+}{
+	lastSeen: make(map[string]time.Time),
+	idled:    make(map[string]int),
+}
+
+// observeSessionActivity records a request for session and reports whether
+// the session went idle for longer than threshold recently, i.e. within the
+// last idleDecayRequests requests.
+func observeSessionActivity(session string, now time.Time, threshold time.Duration) bool {
+	if session == "" {
+		return false
+	}
+
+	sessionActivity.Lock()
+	defer sessionActivity.Unlock()
+
+	if now.Sub(sessionActivity.lastSweep) > sessionSweepInterval {
+		// Keep sessions long enough to tell they went idle.
+		retention := max(sessionRetention, threshold)
+		for s, last := range sessionActivity.lastSeen {
+			if now.Sub(last) > retention {
+				delete(sessionActivity.lastSeen, s)
+				delete(sessionActivity.idled, s)
+			}
+		}
+		sessionActivity.lastSweep = now
+	}
+
+	last, ok := sessionActivity.lastSeen[session]
+	sessionActivity.lastSeen[session] = now
+	switch {
+	case ok && now.Sub(last) > threshold:
+		sessionActivity.idled[session] = idleDecayRequests
+		return true
+	case sessionActivity.idled[session] > 1:
+		sessionActivity.idled[session]--
+		return true
+	default:
+		delete(sessionActivity.idled, session)
+		return false
+	}
+}
+
+func isCacheBreakpoint(cc *anthropic.BetaCacheControlEphemeralParam) bool {
+	return cc != nil && cc.Type != ""
+}
+
+// cacheBreakpoints returns every breakpoint in the request in the order they
+// should be dropped when there are too many: conversation history oldest
+// first, then the system prompt, then tools.
+func cacheBreakpoints(params *anthropic.BetaMessageNewParams) []*anthropic.BetaCacheControlEphemeralParam {
+	var breakpoints []*anthropic.BetaCacheControlEphemeralParam
+	for _, msg := range params.Messages {
+		for _, block := range msg.Content {
+			if cc := block.GetCacheControl(); isCacheBreakpoint(cc) {
+				breakpoints = append(breakpoints, cc)
+			}
+		}
+	}
+	for i := range params.System {
+		if cc := &params.System[i].CacheControl; isCacheBreakpoint(cc) {
+			breakpoints = append(breakpoints, cc)
+		}
+	}
+	for _, tool := range params.Tools {
+		if cc := tool.GetCacheControl(); isCacheBreakpoint(cc) {
+			breakpoints = append(breakpoints, cc)
+		}
+	}
+	return breakpoints
+}
+
+func stripMessageBreakpoints(messages []anthropic.BetaMessageParam) int {
+	var n int
+	for _, msg := range messages {
+		for _, block := range msg.Content {
+			if cc := block.GetCacheControl(); isCacheBreakpoint(cc) {
+				*cc = anthropic.BetaCacheControlEphemeralParam{}
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func enforceBreakpointLimit(params *anthropic.BetaMessageNewParams) int {
+	breakpoints := cacheBreakpoints(params)
+	excess := len(breakpoints) - maxCacheBreakpoints
+	for i := 0; i < excess; i++ {
+		*breakpoints[i] = anthropic.BetaCacheControlEphemeralParam{}
+	}
+	return max(excess, 0)
+}
+
+// messageBreakpointTargets returns the indexes of the messages to mark, most
+// important first: the last user turn, then user turns at or before each
+// earlier multiple of the stable interval.
+func messageBreakpointTargets(messages []anthropic.BetaMessageParam, cfg CacheControlConfig) []int {
+	last := lastUserMessage(messages, len(messages)-1)
+	if cfg.Messages <= 0 || last < 0 {
+		return nil
+	}
+
+	targets := []int{last}
+	if cfg.StableInterval <= 0 {
+		return targets
+	}
+	for n := 0; len(targets) < cfg.Messages; n++ {
+		snapped := (last/cfg.StableInterval - n) * cfg.StableInterval
+		if snapped < 0 {
+			break
+		}
+		idx := lastUserMessage(messages, snapped)
+		if idx >= 0 && idx < targets[len(targets)-1] {
+			targets = append(targets, idx)
+		}
+	}
+	return targets
+}
+
+// lastUserMessage returns the index of the last user message at or before
+// from, or -1.
+func lastUserMessage(messages []anthropic.BetaMessageParam, from int) int {
+	for i := min(from, len(messages)-1); i >= 0; i-- {
+		if messages[i].Role == anthropic.BetaMessageParamRoleUser {
+			return i
+		}
+	}
+	return -1
+}
+
+// markMessage puts a breakpoint on the last block of msg that can carry one.
+func markMessage(msg anthropic.BetaMessageParam, ttl anthropic.BetaCacheControlEphemeralTTL) bool {
+	for i := len(msg.Content) - 1; i >= 0; i-- {
+		block := msg.Content[i]
+		if text := block.GetText(); text != nil && *text == "" {
+			// Empty text blocks can't be cached.
+			continue
+		}
+		if cc := block.GetCacheControl(); cc != nil {
+			*cc = newCacheControl(ttl)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestObserveSessionActivity(t *testing.T) {
+	start := time.Now().Add(24 * time.Hour)
+	threshold := 5 * time.Minute
+
+	if observeSessionActivity("busy", start, threshold) {
+		t.Error("new session reported idle")
+	}
+	if observeSessionActivity("busy", start.Add(time.Minute), threshold) {
+		t.Error("session reported idle after a minute")
+	}
+	if !observeSessionActivity("busy", start.Add(10*time.Minute), threshold) {
+		t.Error("session not reported idle after ten minutes")
+	}
+	if !observeSessionActivity("busy", start.Add(11*time.Minute), threshold) {
+		t.Error("idle session forgotten")
+	}
+
+	// A run of busy requests wears the idle pause off.
+	now := start.Add(11 * time.Minute)
+	for i := 2; i < idleDecayRequests; i++ {
+		now = now.Add(time.Minute)
+		if !observeSessionActivity("busy", now, threshold) {
+			t.Fatalf("idle session forgotten after %d busy requests", i)
+		}
+	}
+	now = now.Add(time.Minute)
+	if observeSessionActivity("busy", now, threshold) {
+		t.Errorf("session still idle after %d busy requests", idleDecayRequests)
+	}
+	now = now.Add(10 * time.Minute)
+	if !observeSessionActivity("busy", now, threshold) {
+		t.Error("session not reported idle after another pause")
+	}
+
+	// Past the longest TTL nothing is cached, so the session starts over.
+	later := now.Add(sessionRetention + time.Second)
+	observeSessionActivity("other", later, threshold)
+	sessionActivity.Lock()
+	_, seen := sessionActivity.lastSeen["busy"]
+	_, idled := sessionActivity.idled["busy"]
+	sessionActivity.Unlock()
+	if seen || idled {
+		t.Error("session idle for longer than the longest TTL not evicted")
+	}
+	if observeSessionActivity("busy", later, threshold) {
+		t.Error("evicted session reported idle")
+	}
+}
+
+// testParams builds a request from a string of message roles, 'u' for user
+// and 'a' for assistant, with a text block per message. System blocks, tools
+// and the messages in marked carry a client breakpoint where asked to.
+func testParams(t *testing.T, system, tools []bool, roles string, marked ...int) *anthropic.BetaMessageNewParams {
+	t.Helper()
+	breakpoint := map[string]any{"type": "ephemeral"}
+	req := map[string]any{"model": "claude-sonnet-4-20250514", "max_tokens": 1024}
+	var systemBlocks, toolList, messages []map[string]any
+	for i, set := range system {
+		block := map[string]any{"type": "text", "text": fmt.Sprintf("system %d", i)}
+		if set {
+			block["cache_control"] = breakpoint
+		}
+		systemBlocks = append(systemBlocks, block)
+	}
+	for i, set := range tools {
+		tool := map[string]any{"name": fmt.Sprintf("Tool%d", i), "input_schema": map[string]any{"type": "object"}}
+		if set {
+			tool["cache_control"] = breakpoint
+		}
+		toolList = append(toolList, tool)
+	}
+	for i, r := range roles {
+		role := "user"
+		if r == 'a' {
+			role = "assistant"
+		}
+		block := map[string]any{"type": "text", "text": fmt.Sprintf("message %d", i)}
+		if slices.Contains(marked, i) {
+			block["cache_control"] = breakpoint
+		}
+		messages = append(messages, map[string]any{"role": role, "content": []map[string]any{block}})
+	}
+	req["system"], req["tools"], req["messages"] = systemBlocks, toolList, messages
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := parseMessageParams(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &params
+}
+
+func TestMessageBreakpointTargets(t *testing.T) {
+	tests := []struct {
+		name           string
+		roles          string
+		messages       int
+		stableInterval int
+		want           []int
+	}{
+		{"disabled", "uauau", 0, 2, nil},
+		{"no messages", "", 3, 2, nil},
+		{"no user message", "a", 3, 2, nil},
+		{"last turn only", "uauau", 3, 0, []int{4}},
+		{"assistant last", "uaua", 1, 2, []int{2}},
+		{"snapped", "uauau", 3, 2, []int{4, 2, 0}},
+		{"capped", "uauauauauau", 2, 2, []int{10, 8}},
+		{"snapped to assistant", "uauauaua", 2, 3, []int{6, 2}},
+		{"snapped past the start", "uauau", 3, 10, []int{4, 0}},
+		{"snap on last turn", "uauauauauau", 2, 10, []int{10, 0}},
+		{"long conversation", strings.Repeat("ua", 12) + "u", 3, 10, []int{24, 20, 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := testParams(t, nil, nil, tt.roles)
+			cfg := CacheControlConfig{Messages: tt.messages, StableInterval: tt.stableInterval}
+			if got := messageBreakpointTargets(params.Messages, cfg); !slices.Equal(got, tt.want) {
+				t.Errorf("targets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlterCacheControlPlacement(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   func(t *testing.T) *anthropic.BetaMessageNewParams
+		messages int
+		want     []string
+	}{
+		{
+			name: "budget used by client system and tool breakpoints",
+			params: func(t *testing.T) *anthropic.BetaMessageNewParams {
+				return testParams(t, []bool{true, true}, []bool{true, false}, "uauau")
+			},
+			messages: 3,
+			want:     []string{"tools.Tool0 5m", "tools.Tool1 5m", "system[0] 5m", "system[1] 5m"},
+		},
+		{
+			name: "budget left for some messages",
+			params: func(t *testing.T) *anthropic.BetaMessageNewParams {
+				return testParams(t, []bool{true, false}, []bool{false, false}, "uauau")
+			},
+			messages: 3,
+			want:     []string{"tools.Tool1 5m", "system[0] 5m", "messages[2].content[0] 5m", "messages[4].content[0] 5m"},
+		},
+		{
+			name: "client message breakpoints replaced",
+			params: func(t *testing.T) *anthropic.BetaMessageNewParams {
+				return testParams(t, nil, []bool{false}, "uauau", 0, 1)
+			},
+			messages: 1,
+			want:     []string{"tools.Tool0 5m", "messages[4].content[0] 5m"},
+		},
+		{
+			name: "client message breakpoints kept",
+			params: func(t *testing.T) *anthropic.BetaMessageNewParams {
+				return testParams(t, nil, []bool{false}, "uauau", 0, 1)
+			},
+			want: []string{"tools.Tool0 5m", "messages[0].content[0] 5m", "messages[1].content[0] 5m"},
+		},
+		{
+			name: "oldest client message breakpoint dropped",
+			params: func(t *testing.T) *anthropic.BetaMessageNewParams {
+				return testParams(t, []bool{true}, []bool{false}, "uauau", 0, 2, 4)
+			},
+			want: []string{"tools.Tool0 5m", "system[0] 5m", "messages[2].content[0] 5m", "messages[4].content[0] 5m"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &transformContext{
+				params:  tt.params(t),
+				request: httptest.NewRequest(http.MethodPost, "/v1/messages", nil),
+			}
+			tc.transforms.CacheControl = CacheControlConfig{
+				Tools:          true,
+				Messages:       tt.messages,
+				StableInterval: 2,
+				TTL:            CacheTTLConfig{Tools: cacheTTL5m, System: cacheTTL5m, Messages: cacheTTL5m},
+			}
+			alterCacheControl(tc)
+			if got := cacheBreakpointPlacements(tc.params); !slices.Equal(got, tt.want) {
+				t.Errorf("breakpoints = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		texts []string
+		want  int
+	}{
+		{"last block", []string{"first", "second"}, 1},
+		{"empty text skipped", []string{"first", ""}, 0},
+		{"only empty text", []string{"", ""}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := anthropic.BetaMessageParam{Role: anthropic.BetaMessageParamRoleUser}
+			for _, text := range tt.texts {
+				msg.Content = append(msg.Content, anthropic.NewBetaTextBlock(text))
+			}
+			if marked := markMessage(msg, ""); marked != (tt.want >= 0) {
+				t.Errorf("markMessage = %v, want %v", marked, tt.want >= 0)
+			}
+			for i, block := range msg.Content {
+				if got := isCacheBreakpoint(block.GetCacheControl()); got != (i == tt.want) {
+					t.Errorf("block %d breakpoint = %v", i, got)
+				}
+			}
+		})
+	}
+}
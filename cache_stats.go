@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// cacheStats tracks how well prompt caching works for a group of requests.
+type cacheStats struct {
+	requests int
+	// Input tokens that were neither read from nor written to the cache.
+	uncached int64
+	creation int64
+	read     int64
+	// Cost of the input tokens as billed, and what they would have cost with
+	// no caching at all.
+	actualCost   float64
+	baselineCost float64
+
+	firstSeen, lastSeen time.Time
+}
+
+func (s *cacheStats) record(u usage, price ModelPrice, now time.Time) {
+	if s.requests == 0 {
+		s.firstSeen = now
+	}
+	s.lastSeen = now
+	s.requests++
+	s.uncached += u.InputTokens
+	s.creation += u.CacheCreationInputTokens
+	s.read += u.CacheReadInputTokens
+	s.actualCost += (float64(u.InputTokens)*price.Input +
+		price.cacheWriteCost(u) +
+		float64(u.CacheReadInputTokens)*price.CacheRead) / 1e6
+	s.baselineCost += float64(u.InputTokens+u.CacheCreationInputTokens+u.CacheReadInputTokens) * price.Input / 1e6
+}
+
+// hitRatio is the share of input tokens served from the cache.
+func (s cacheStats) hitRatio() float64 {
+	total := s.uncached + s.creation + s.read
+	if total == 0 {
+		return 0
+	}
+	return float64(s.read) / float64(total)
+}
+
+func (s cacheStats) savings() float64 {
+	return s.baselineCost - s.actualCost
+}
+
+func (s cacheStats) String() string {
+	var savedPct float64
+	if s.baselineCost > 0 {
+		savedPct = 100 * s.savings() / s.baselineCost
+	}
+	return fmt.Sprintf("%d requests, hit %.1f%% (read %d, write %d, uncached %d), saved $%.4f (%.0f%% of input cost)",
+		s.requests, 100*s.hitRatio(), s.read, s.creation, s.uncached, s.savings(), savedPct)
+}
+
+// cacheAnalytics aggregates cacheStats per model and per Claude Code session.
+// Sessions idle for longer than sessionRetention are dropped.
+var cacheAnalytics = struct {
+	sync.Mutex
+	byModel   map[anthropic.Model]*cacheStats
+	bySession map[string]*cacheStats
+	lastSweep time.Time
+	// Set whenever something is recorded, cleared by the periodic report.
+	dirty bool
+}{
+	byModel:   make(map[anthropic.Model]*cacheStats),
+	bySession: make(map[string]*cacheStats),
+}
+
+func recordCacheStats(model anthropic.Model, session string, u usage, price ModelPrice) {
+	now := time.Now()
+
+	cacheAnalytics.Lock()
+	defer cacheAnalytics.Unlock()
+
+	stats, ok := cacheAnalytics.byModel[model]
+	if !ok {
+		stats = &cacheStats{}
+		cacheAnalytics.byModel[model] = stats
+	}
+	stats.record(u, price, now)
+
+	if now.Sub(cacheAnalytics.lastSweep) > sessionSweepInterval {
+		for s, stats := range cacheAnalytics.bySession {
+			if now.Sub(stats.lastSeen) > sessionRetention {
+				delete(cacheAnalytics.bySession, s)
+			}
+		}
+		cacheAnalytics.lastSweep = now
+	}
+	if session != "" {
+		stats, ok := cacheAnalytics.bySession[session]
+		if !ok {
+			stats = &cacheStats{}
+			cacheAnalytics.bySession[session] = stats
+		}
+		stats.record(u, price, now)
+	}
+	cacheAnalytics.dirty = true
+}
+
+// sessionFromUserID extracts the Claude Code session ID from the request
+// metadata, which looks like "user_<hash>_account_<uuid>_session_<uuid>".
+func sessionFromUserID(userID string) string {
+	if _, session, ok := strings.Cut(userID, "_session_"); ok {
+		return session
+	}
+	return userID
+}
+
+// cacheReport renders the current cache statistics, one line per model and
+// per session.
+func cacheReport() []string {
+	cacheAnalytics.Lock()
+	defer cacheAnalytics.Unlock()
+
+	var lines []string
+	models := make([]string, 0, len(cacheAnalytics.byModel))
+	for model := range cacheAnalytics.byModel {
+		models = append(models, string(model))
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		lines = append(lines, fmt.Sprintf("model %s: %s", model, cacheAnalytics.byModel[anthropic.Model(model)]))
+	}
+
+	sessions := make([]string, 0, len(cacheAnalytics.bySession))
+	for session := range cacheAnalytics.bySession {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return cacheAnalytics.bySession[sessions[i]].firstSeen.Before(cacheAnalytics.bySession[sessions[j]].firstSeen)
+	})
+	for _, session := range sessions {
+		stats := cacheAnalytics.bySession[session]
+		lines = append(lines, fmt.Sprintf("session %s (%s - %s): %s", session,
+			stats.firstSeen.Format(time.TimeOnly), stats.lastSeen.Format(time.TimeOnly), stats))
+	}
+	return lines
+}
+
+func printCacheReport(title string) {
+	lines := cacheReport()
+	if len(lines) == 0 {
+		return
+	}
+	printBlue(context.Background(), "%s:\n", title)
+	for _, line := range lines {
+		printBlue(context.Background(), "  %s\n", line)
+	}
+}
+
+// reportCacheStatsPeriodically prints the cache report at every interval in
+// which new requests were recorded. A zero interval turns the report off. It
+// never returns.
+func reportCacheStatsPeriodically(interval func() time.Duration) {
+	for {
+		d := interval()
+		if d <= 0 {
+			time.Sleep(watchInterval)
+			continue
+		}
+		time.Sleep(d)
+
+		cacheAnalytics.Lock()
+		dirty := cacheAnalytics.dirty
+		cacheAnalytics.dirty = false
+		cacheAnalytics.Unlock()
+
+		if dirty {
+			printCacheReport("Prompt cache statistics")
+		}
+	}
+}
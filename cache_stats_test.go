@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordCacheStatsEvictsIdleSessions(t *testing.T) {
+	cacheAnalytics.Lock()
+	cacheAnalytics.bySession["idle"] = &cacheStats{requests: 1, lastSeen: time.Now().Add(-sessionRetention - time.Minute)}
+	cacheAnalytics.bySession["recent"] = &cacheStats{requests: 1, lastSeen: time.Now().Add(-time.Minute)}
+	cacheAnalytics.lastSweep = time.Time{}
+	cacheAnalytics.Unlock()
+
+	recordCacheStats("claude-sonnet-4-20250514", "active", usage{InputTokens: 10}, ModelPrice{Input: 3})
+
+	cacheAnalytics.Lock()
+	defer cacheAnalytics.Unlock()
+	if _, ok := cacheAnalytics.bySession["idle"]; ok {
+		t.Error("idle session not evicted")
+	}
+	for _, session := range []string{"recent", "active"} {
+		if _, ok := cacheAnalytics.bySession[session]; !ok {
+			t.Errorf("session %s evicted", session)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// CannedResponse answers matching /v1/messages requests in the proxy instead
+// of sending them upstream. It is meant for throwaway side calls whose
+// answer doesn't matter much, such as the spinner word or topic detection.
+//
+// All match fields must match; empty ones match anything. The response is
+// exactly one of Text, Template or Value.
+type CannedResponse struct {
+	// Shown in the log when the rule fires.
+	Name   string   `yaml:"name"`
+	Models []string `yaml:"models"`
+	// Text pattern (substring or /regex/) the system prompt must match.
+	System string `yaml:"system"`
+	// Number of system prompt blocks. Zero means any.
+	SystemBlocks int `yaml:"system_blocks"`
+	// Number of messages in the request. Zero means any.
+	MessageCount int `yaml:"message_count"`
+	// Text pattern the last user message must match.
+	LastUser string `yaml:"last_user"`
+
+	// Static response text.
+	Text string `yaml:"text"`
+	// Asset file holding a template executed with CannedTemplateData.
+	Template string `yaml:"template"`
+	// Name of a computed value, see cannedValues.
+	Value string `yaml:"value"`
+}
+
+// CannedTemplateData is what canned response templates are executed with.
+type CannedTemplateData struct {
+	Model           string
+	System          string
+	LastUserMessage string
+	MessageCount    int
+}
+
+// cannedValues computes the responses available to the value field of a
+// canned response.
+var cannedValues = map[string]func(data CannedTemplateData) string{
+	// First line of the last user message, shortened to a few words.
+	"title": func(data CannedTemplateData) string {
+		line, _, _ := strings.Cut(strings.TrimSpace(data.LastUserMessage), "\n")
+		words := strings.Fields(line)
+		if len(words) > 6 {
+			words = words[:6]
+		}
+		return strings.Join(words, " ")
+	},
+	"timestamp": func(CannedTemplateData) string {
+		return time.Now().Format(time.RFC3339)
+	},
+}
+
+// haikuGerundRule is the rule behind suppress_haiku: Claude Code asks Haiku
+// for a whimsical verb to show next to the spinner on every prompt, with the
+// instructions as the only system block.
+var haikuGerundRule = CannedResponse{
+	Name:         "haiku_gerund",
+	Models:       []string{string(anthropic.ModelClaude3_5Haiku20241022)},
+	SystemBlocks: 1,
+	System:       "Analyze this message and come up with a single positive, cheerful and delightful verb in gerund form that's related to the message. Only include the word with no other text or punctuation. The word should have the first letter capitalized. Add some whimsy and surprise to entertain the user. Ensure the word is highly relevant to the user's message.",
+	Text:         "Processing",
+}
+
+// cannedRules returns the configured canned responses, preceded by the
+// built-in ones that are switched on.
+func (c Config) cannedRules() []CannedResponse {
+	var rules []CannedResponse
+	if c.SuppressHaiku {
+		rules = append(rules, haikuGerundRule)
+	}
+	return append(rules, c.CannedResponses...)
+}
+
+func (rule CannedResponse) validate() error {
+	responses := 0
+	for _, s := range []string{rule.Text, rule.Template, rule.Value} {
+		if s != "" {
+			responses++
+		}
+	}
+	if responses != 1 {
+		return errors.New("exactly one of text, template and value must be set")
+	}
+	if _, ok := cannedValues[rule.Value]; rule.Value != "" && !ok {
+		return fmt.Errorf("unknown value %q", rule.Value)
+	}
+	if err := validateModelPatterns(rule.Models); err != nil {
+		return err
+	}
+	for _, pattern := range []string{rule.System, rule.LastUser} {
+		if _, err := matchTextPattern(pattern, ""); err != nil {
+			return fmt.Errorf("invalid text pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (rule CannedResponse) matches(params *anthropic.BetaMessageNewParams, data CannedTemplateData) bool {
+	if len(rule.Models) > 0 && !matchModel(rule.Models, params.Model) {
+		return false
+	}
+	if rule.MessageCount > 0 && rule.MessageCount != len(params.Messages) {
+		return false
+	}
+	if rule.SystemBlocks > 0 && rule.SystemBlocks != len(params.System) {
+		return false
+	}
+	if ok, err := matchTextPattern(rule.System, data.System); err != nil || !ok {
+		return false
+	}
+	ok, err := matchTextPattern(rule.LastUser, data.LastUserMessage)
+	return err == nil && ok
+}
+
+func (rule CannedResponse) respond(state *runtimeState, data CannedTemplateData) (string, error) {
+	switch {
+	case rule.Template != "":
+		return processTemplate(state.prompts, rule.Template, data)
+	case rule.Value != "":
+		return cannedValues[rule.Value](data), nil
+	}
+	return rule.Text, nil
+}
+
+// lastUserText returns the text of the last user message.
+func lastUserText(params *anthropic.BetaMessageNewParams) string {
+	idx := lastUserMessage(params.Messages, len(params.Messages)-1)
+	if idx < 0 {
+		return ""
+	}
+	var texts []string
+	for _, block := range params.Messages[idx].Content {
+		if text := block.GetText(); text != nil {
+			texts = append(texts, *text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// answerCannedResponse replies to the request itself if a canned response
+// rule matches it.
+func answerCannedResponse(r *http.Request, params *anthropic.BetaMessageNewParams, w http.ResponseWriter, state *runtimeState) bool {
+	rules := state.config.cannedRules()
+	if len(rules) == 0 {
+		return false
+	}
+
+	data := CannedTemplateData{
+		Model:           string(params.Model),
+		System:          systemText(params),
+		LastUserMessage: lastUserText(params),
+		MessageCount:    len(params.Messages),
+	}
+	for _, rule := range rules {
+		if !rule.matches(params, data) {
+			continue
+		}
+		text, err := rule.respond(state, data)
+		if err != nil {
+			printRed(r.Context(), "Error producing canned response %s: %v\n", rule.Name, err)
+			return false
+		}
+		printYellow(r.Context(), "Answering with canned response %s\n", rule.Name)
+		writeSyntheticResponse(r.Context(), w, textMessageEvents(params.Model, text), isStreaming(params))
+		return true
+	}
+	return false
+}
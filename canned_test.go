@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestHaikuGerundRule(t *testing.T) {
+	instructions := anthropic.BetaTextBlockParam{Text: haikuGerundRule.System}
+	other := anthropic.BetaTextBlockParam{Text: "You are Claude Code."}
+	tests := []struct {
+		name   string
+		model  anthropic.Model
+		system []anthropic.BetaTextBlockParam
+		want   bool
+	}{
+		{"spinner word", anthropic.ModelClaude3_5Haiku20241022, []anthropic.BetaTextBlockParam{instructions}, true},
+		{"other model", anthropic.ModelClaude3_5HaikuLatest, []anthropic.BetaTextBlockParam{instructions}, false},
+		{"extra system block", anthropic.ModelClaude3_5Haiku20241022, []anthropic.BetaTextBlockParam{other, instructions}, false},
+		{"other system prompt", anthropic.ModelClaude3_5Haiku20241022, []anthropic.BetaTextBlockParam{other}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := &anthropic.BetaMessageNewParams{Model: tt.model, System: tt.system}
+			data := CannedTemplateData{System: systemText(params)}
+			if got := haikuGerundRule.matches(params, data); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// tokenCountFields are the count_tokens request fields that affect the count.
+// Everything else, e.g. metadata or stream, is ignored when hashing.
+var tokenCountFields = []string{
+	"model",
+	"system",
+	"messages",
+	"tools",
+	"tool_choice",
+	"thinking",
+	"mcp_servers",
+}
+
+// canonicalizeRequest returns a canonical encoding of a JSON request body
+// that keeps only the given top-level fields. Object keys are sorted and
+// insignificant whitespace is dropped, so requests that differ only in key
+// order, formatting or ignored fields encode the same. Numbers are kept as
+// written.
+func canonicalizeRequest(body []byte, fields []string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var request map[string]any
+	if err := dec.Decode(&request); err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, errors.New("request body is not a JSON object")
+	}
+
+	canonical := make(map[string]any, len(fields))
+	for _, field := range fields {
+		if value, ok := request[field]; ok {
+			canonical[field] = value
+		}
+	}
+	return json.Marshal(canonical)
+}
+
+// hashTokenCountRequest returns the cache key of a count_tokens request. Bodies
+// that don't parse are hashed as they are.
+func hashTokenCountRequest(ctx context.Context, body []byte) string {
+	canonical, err := canonicalizeRequest(body, tokenCountFields)
+	if err != nil {
+		printYellow(ctx, "Hashing unparseable token count request as is: %v\n", err)
+		return hashRequestBody(body)
+	}
+	return hashRequestBody(canonical)
+}
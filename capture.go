@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CaptureConfig archives requests and responses on disk so you can inspect
+// exactly what was sent upstream and what came back. Secrets are redacted
+// from everything written. Each captured request gets its own directory
+// under Dir:
+//
+//	request.json      the body as the client sent it
+//	transformed.json  the body as it was forwarded, if the booster changed it
+//	diff.json         what changed between the two, see requestChange
+//	response.sse      the response as the client received it (response.json
+//	                  for non-streaming responses)
+//	meta.json         IDs, status, timing and headers
+type CaptureConfig struct {
+	// Empty turns capturing off.
+	Dir string `yaml:"dir"`
+	// Share of requests to capture, from 0 to 1.
+	Sample float64 `yaml:"sample"`
+	// Bodies are cut off at this size. 0 means no limit.
+	MaxBodyBytes int `yaml:"max_body_bytes"`
+	// Captures older than this are deleted. 0 keeps them forever.
+	Retention time.Duration `yaml:"retention"`
+	// Only the newest max_captures are kept. 0 means no limit.
+	MaxCaptures int `yaml:"max_captures"`
+}
+
+func (c CaptureConfig) validate() error {
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("capture: sample must be between 0 and 1, got %v", c.Sample)
+	}
+	if c.MaxBodyBytes < 0 || c.Retention < 0 || c.MaxCaptures < 0 {
+		return errors.New("capture: max_body_bytes, retention and max_captures must not be negative")
+	}
+	return nil
+}
+
+// Layout of capture directory names, which sort in capture order.
+const captureTimeLayout = "20060102-150405.000"
+
+// How often old captures are pruned.
+const capturePruneInterval = time.Minute
+
+// capture collects a request while it is handled.
+type capture struct {
+	config      CaptureConfig
+	redactor    *redactor
+	original    []byte
+	transformed []byte
+	diff        []requestChange
+}
+
+type captureMeta struct {
+	ID             string      `json:"id"`
+	Method         string      `json:"method"`
+	Path           string      `json:"path"`
+	Model          string      `json:"model,omitempty"`
+	Session        string      `json:"session,omitempty"`
+	Status         int         `json:"status"`
+	Start          time.Time   `json:"start"`
+	FirstByteMS    int64       `json:"first_byte_ms"`
+	DurationMS     int64       `json:"duration_ms"`
+	RequestHeader  http.Header `json:"request_header"`
+	ResponseHeader http.Header `json:"response_header"`
+	// Files cut off at max_body_bytes.
+	Truncated []string `json:"truncated,omitempty"`
+}
+
+const captureKey contextKey = "capture"
+
+func addCaptureToContext(ctx context.Context, c *capture) context.Context {
+	return context.WithValue(ctx, captureKey, c)
+}
+
+func getCaptureFromContext(ctx context.Context) (*capture, bool) {
+	c, ok := ctx.Value(captureKey).(*capture)
+	return c, ok
+}
+
+// startCapture decides whether to capture r and if so keeps a copy of its
+// body as the client sent it.
+func startCapture(r *http.Request, state *runtimeState) {
+	config := state.config.Capture
+	if config.Dir == "" || rand.Float64() >= config.Sample {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		printRed(r.Context(), "Error reading request body for capture: %v\n", err)
+		return
+	}
+	*r = *r.WithContext(addCaptureToContext(r.Context(), &capture{config: config, redactor: state.redactor, original: body}))
+}
+
+// captureRequestDiff records what the booster changed in the request.
+func captureRequestDiff(r *http.Request, changes []requestChange) {
+	if c, ok := getCaptureFromContext(r.Context()); ok {
+		c.diff = changes
+	}
+}
+
+// captureTransformedRequest records the body that is forwarded upstream in
+// place of the client's.
+func captureTransformedRequest(r *http.Request, body []byte) {
+	if c, ok := getCaptureFromContext(r.Context()); ok {
+		c.transformed = body
+	}
+}
+
+// finishCapture writes the capture of a request once its response is
+// complete.
+func finishCapture(w *responseLogger, r *http.Request) {
+	c, ok := getCaptureFromContext(r.Context())
+	if !ok {
+		return
+	}
+	info, _ := getRequestInfoFromContext(r.Context())
+	end := time.Now()
+
+	info.mu.Lock()
+	meta := captureMeta{
+		ID:             info.id,
+		Method:         r.Method,
+		Path:           info.path,
+		Model:          string(info.model),
+		Session:        info.session,
+		Status:         w.statusCode,
+		Start:          info.start,
+		DurationMS:     end.Sub(info.start).Milliseconds(),
+		RequestHeader:  c.redactor.redactHeader(r.Header),
+		ResponseHeader: c.redactor.redactHeader(w.Header()),
+	}
+	info.mu.Unlock()
+	if !w.firstByte.IsZero() {
+		meta.FirstByteMS = w.firstByte.Sub(info.start).Milliseconds()
+	}
+
+	dir := filepath.Join(c.config.Dir, info.start.Format(captureTimeLayout)+"-"+info.id)
+	if err := c.write(dir, &meta, w.body.Bytes()); err != nil {
+		printRed(r.Context(), "Error writing capture %s: %v\n", dir, err)
+		return
+	}
+	printDebug(r.Context(), "Captured request in %s\n", dir)
+}
+
+func (c *capture) write(dir string, meta *captureMeta, response []byte) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	responseFile := "response.json"
+	if strings.HasPrefix(meta.ResponseHeader.Get("Content-Type"), "text/event-stream") {
+		responseFile = "response.sse"
+	}
+	files := []struct {
+		name string
+		body []byte
+	}{
+		{"request.json", c.original},
+		{"transformed.json", c.transformed},
+		{responseFile, response},
+	}
+	if c.diff != nil {
+		diff, err := json.MarshalIndent(c.diff, "", "  ")
+		if err != nil {
+			return err
+		}
+		files = append(files, struct {
+			name string
+			body []byte
+		}{"diff.json", diff})
+	}
+	for _, f := range files {
+		if f.body == nil {
+			continue
+		}
+		// Redact before truncating so no partial secret survives the cut.
+		var body []byte
+		if f.name == "response.sse" {
+			body = c.redactor.redactStream(f.body)
+		} else {
+			body = c.redactor.redact(f.body)
+		}
+		if limit := c.config.MaxBodyBytes; limit > 0 && len(body) > limit {
+			body = body[:limit]
+			meta.Truncated = append(meta.Truncated, f.name)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.name), body, 0o600); err != nil {
+			return err
+		}
+	}
+
+	metaBytes, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "meta.json"), metaBytes, 0o600)
+}
+
+// pruneCaptures deletes the captures in config.Dir that are past the
+// retention period or beyond max_captures, oldest first.
+func pruneCaptures(config CaptureConfig, now time.Time) error {
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	// Only touch directories that look like captures.
+	var captures []string
+	for _, entry := range entries {
+		if len(entry.Name()) < len(captureTimeLayout) || !entry.IsDir() {
+			continue
+		}
+		if _, err := time.ParseInLocation(captureTimeLayout, entry.Name()[:len(captureTimeLayout)], time.Local); err == nil {
+			captures = append(captures, entry.Name())
+		}
+	}
+	sort.Strings(captures)
+
+	pruned := 0
+	for i, name := range captures {
+		expired := false
+		if config.Retention > 0 {
+			start, _ := time.ParseInLocation(captureTimeLayout, name[:len(captureTimeLayout)], time.Local)
+			expired = now.Sub(start) > config.Retention
+		}
+		excess := config.MaxCaptures > 0 && len(captures)-i > config.MaxCaptures
+		if !expired && !excess {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(config.Dir, name)); err != nil {
+			return err
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		printDebug(context.Background(), "Pruned %d old captures from %s\n", pruned, config.Dir)
+	}
+	return nil
+}
+
+// pruneCapturesPeriodically applies the capture retention settings every
+// capturePruneInterval. It never returns.
+func pruneCapturesPeriodically() {
+	for {
+		if config := liveState.Load().config.Capture; config.Dir != "" {
+			if err := pruneCaptures(config, time.Now()); err != nil {
+				printRed(context.Background(), "Error pruning captures in %s: %v\n", config.Dir, err)
+			}
+		}
+		time.Sleep(capturePruneInterval)
+	}
+}
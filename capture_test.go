@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneCaptures(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local)
+	name := func(age time.Duration) string {
+		return now.Add(-age).Format(captureTimeLayout) + "-0a1b2c3d"
+	}
+	// Oldest first.
+	captures := []string{name(10 * 24 * time.Hour), name(8 * 24 * time.Hour), name(2 * time.Hour), name(time.Minute)}
+
+	tests := []struct {
+		name   string
+		config CaptureConfig
+		want   []string
+	}{
+		{"no limits", CaptureConfig{}, captures},
+		{"retention", CaptureConfig{Retention: 7 * 24 * time.Hour}, captures[2:]},
+		{"max captures", CaptureConfig{MaxCaptures: 3}, captures[1:]},
+		{"both", CaptureConfig{Retention: time.Hour, MaxCaptures: 3}, captures[3:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, c := range captures {
+				if err := os.Mkdir(filepath.Join(dir, c), 0o700); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// None of these are captures, however old they look.
+			others := []string{"notes", "20200101-000000.000-x.txt", "2020-01-01"}
+			os.Mkdir(filepath.Join(dir, others[0]), 0o700)
+			os.WriteFile(filepath.Join(dir, others[1]), nil, 0o600)
+			os.Mkdir(filepath.Join(dir, others[2]), 0o700)
+
+			tt.config.Dir = dir
+			if err := pruneCaptures(tt.config, now); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Name())
+			}
+			want := append(slices.Clone(tt.want), others...)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("left %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPruneCapturesMissingDir(t *testing.T) {
+	config := CaptureConfig{Dir: filepath.Join(t.TempDir(), "missing"), MaxCaptures: 1}
+	if err := pruneCaptures(config, time.Now()); err != nil {
+		t.Errorf("pruneCaptures on a missing dir: %v", err)
+	}
+}
+
+func TestFinishCapture(t *testing.T) {
+	dir := t.TempDir()
+	state := &runtimeState{
+		config:   Config{Capture: CaptureConfig{Dir: dir, Sample: 1}},
+		redactor: defaultRedactor,
+	}
+
+	body := `{"model":"claude-sonnet-4-20250514","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	r.Header.Set("X-Api-Key", "sk-ant-REDACTED")
+	info := newRequestInfo(r)
+	info.model = "claude-sonnet-4-20250514"
+	r = r.WithContext(addRequestInfoToContext(r.Context(), info))
+
+	startCapture(r, state)
+	captureTransformedRequest(r, []byte(`{"model":"claude-sonnet-4-20250514","temperature":0.1}`))
+
+	w := &responseLogger{ResponseWriter: httptest.NewRecorder()}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"))
+	finishCapture(w, r)
+
+	captureDir := filepath.Join(dir, info.start.Format(captureTimeLayout)+"-"+info.id)
+	for _, file := range []string{"request.json", "transformed.json", "response.sse", "meta.json"} {
+		if _, err := os.Stat(filepath.Join(captureDir, file)); err != nil {
+			t.Errorf("%s not written: %v", file, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(captureDir, "diff.json")); err == nil {
+		t.Error("diff.json written without a diff")
+	}
+
+	request, _ := os.ReadFile(filepath.Join(captureDir, "request.json"))
+	if string(request) != body {
+		t.Errorf("request.json = %s, want the body as sent", request)
+	}
+
+	var meta captureMeta
+	data, err := os.ReadFile(filepath.Join(captureDir, "meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != info.id || meta.Status != http.StatusOK || meta.Path != "/v1/messages" || meta.Model != "claude-sonnet-4-20250514" {
+		t.Errorf("unexpected meta: %+v", meta)
+	}
+	if got := meta.RequestHeader.Get("X-Api-Key"); got != redactedHeaderValue {
+		t.Errorf("X-Api-Key = %q, want it redacted", got)
+	}
+}
+
+func TestStartCaptureSample(t *testing.T) {
+	state := &runtimeState{
+		config:   Config{Capture: CaptureConfig{Dir: t.TempDir(), Sample: 0}},
+		redactor: defaultRedactor,
+	}
+	r := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader("{}"))
+	startCapture(r, state)
+	if _, ok := getCaptureFromContext(r.Context()); ok {
+		t.Error("request captured with sample 0")
+	}
+}
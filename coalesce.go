@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// flightGroup deduplicates concurrent count_tokens requests with the same
+// hash. The first one, the leader, goes upstream; the others wait for its
+// response instead of sending identical requests of their own.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is one request in progress. Its fields are set before done is
+// closed and never change afterwards.
+type flight struct {
+	done       chan struct{}
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+var tokenCountFlights = &flightGroup{flights: make(map[string]*flight)}
+
+// join returns the flight for hash and whether the caller is its leader. The
+// leader must call finish once it has the response.
+func (g *flightGroup) join(hash string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.flights[hash]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[hash] = f
+	return f, true
+}
+
+// finish hands a response to the waiting followers, whether it succeeded or
+// not. A follower that timed out and went upstream itself may finish the
+// flight before the leader does. A zero statusCode abandons the flight, e.g.
+// because the leader's client went away, and sends followers upstream.
+func (g *flightGroup) finish(hash string, statusCode int, header http.Header, body []byte) {
+	g.mu.Lock()
+	f, ok := g.flights[hash]
+	delete(g.flights, hash)
+	g.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	f.statusCode = statusCode
+	f.header = header.Clone()
+	f.body = body
+	close(f.done)
+}
+
+// finishTokenCountFlight finishes the flight of a forwarded count_tokens
+// request, if it has one. Unless the response was proxied completely to a
+// client that is still there, the flight is abandoned rather than shared.
+func finishTokenCountFlight(w *responseLogger, r *http.Request, proxied bool) {
+	hash, ok := getCacheHashFromContext(r.Context())
+	if !ok {
+		return
+	}
+	statusCode := w.statusCode
+	if !proxied || r.Context().Err() != nil {
+		statusCode = 0
+	}
+	tokenCountFlights.finish(hash, statusCode, w.Header(), w.body.Bytes())
+}
+
+// wait blocks until the flight finishes or timeout passes, and reports
+// whether a response is available.
+func (f *flight) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return f.statusCode != 0
+	case <-timer.C:
+		return false
+	}
+}
+
+// writeTo replays the leader's response to w.
+func (f *flight) writeTo(w http.ResponseWriter) {
+	for name, values := range f.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.body)))
+	w.WriteHeader(f.statusCode)
+	w.Write(f.body)
+}
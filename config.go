@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the full booster configuration. It starts from defaultConfig,
+// is overlaid with the -config file if one is given, and finally with any
+// flags that were explicitly set on the command line.
+type Config struct {
+	Target        string           `yaml:"target"`
+	Addr          string           `yaml:"addr"`
+	Port          string           `yaml:"port"`
+	RootDir       string           `yaml:"root_dir"`
+	SuppressHaiku bool             `yaml:"suppress_haiku"`
+	Transforms    TransformsConfig `yaml:"transforms"`
+	ModelSettings []ModelSettings  `yaml:"model_settings"`
+	ModelRewrites []ModelRewrite   `yaml:"model_rewrites"`
+	// USD per million tokens, checked before the built-in price table.
+	Prices []ModelPrice `yaml:"prices"`
+	// How often to print prompt cache statistics. Zero turns it off.
+	CacheReportInterval time.Duration       `yaml:"cache_report_interval"`
+	TokenCache          TokenCacheConfig    `yaml:"token_cache"`
+	TokenCount          TokenCountConfig    `yaml:"token_count"`
+	ResponseCache       ResponseCacheConfig `yaml:"response_cache"`
+	// Checked in order; the built-in rules enabled by suppress_haiku come
+	// first.
+	CannedResponses []CannedResponse `yaml:"canned_responses"`
+	Ollama          OllamaConfig     `yaml:"ollama"`
+	Log             LogConfig        `yaml:"log"`
+	Capture         CaptureConfig    `yaml:"capture"`
+	Redact          RedactConfig     `yaml:"redact"`
+	// Log what the transformers changed in each request.
+	Diff bool `yaml:"diff"`
+}
+
+// TransformsConfig declares every request transformation applied to
+// /v1/messages calls, keyed by transformer name.
+type TransformsConfig struct {
+	Temperature  TemperatureConfig  `yaml:"temperature"`
+	UserPrompt   UserPromptConfig   `yaml:"user_prompt"`
+	SystemPrompt SystemPromptConfig `yaml:"system_prompt"`
+	Tools        ToolsConfig        `yaml:"tools"`
+	CacheControl CacheControlConfig `yaml:"cache_control"`
+	// Any other key configures the custom transformer registered under
+	// that name. Keys naming no registered transformer are rejected.
+	Custom map[string]TransformConfig `yaml:",inline"`
+}
+
+// lookup returns the shared settings of the named transformer. Custom
+// transformers without an entry are enabled for every model.
+func (tc TransformsConfig) lookup(name string) TransformConfig {
+	switch name {
+	case "temperature":
+		return tc.Temperature.TransformConfig
+	case "user_prompt":
+		return tc.UserPrompt.TransformConfig
+	case "system_prompt":
+		return tc.SystemPrompt.TransformConfig
+	case "tools":
+		return tc.Tools.TransformConfig
+	case "cache_control":
+		return tc.CacheControl.TransformConfig
+	}
+	if custom, ok := tc.Custom[name]; ok {
+		return custom
+	}
+	return TransformConfig{Enabled: true}
+}
+
+// TransformConfig holds the settings shared by all transformations.
+type TransformConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Model patterns the transformation is restricted to. Empty means any
+	// model.
+	Models []string `yaml:"models"`
+}
+
+func (tc TransformConfig) applies(model anthropic.Model) bool {
+	return tc.Enabled && (len(tc.Models) == 0 || matchModel(tc.Models, model))
+}
+
+type TemperatureConfig struct {
+	TransformConfig `yaml:",inline"`
+	Value           float64 `yaml:"value"`
+}
+
+type UserPromptConfig struct {
+	TransformConfig `yaml:",inline"`
+	Template        string `yaml:"template"`
+}
+
+type SystemPromptConfig struct {
+	TransformConfig `yaml:",inline"`
+	File            string `yaml:"file"`
+}
+
+type ToolsConfig struct {
+	TransformConfig `yaml:",inline"`
+	// Descriptions longer than this are replaced by the matching asset.
+	MaxDescriptionLength int `yaml:"max_description_length"`
+	// Tool name -> asset file holding the replacement description.
+	Descriptions map[string]string `yaml:"descriptions"`
+	// Tools to drop from the request entirely.
+	Remove []string `yaml:"remove"`
+}
+
+type CacheControlConfig struct {
+	TransformConfig `yaml:",inline"`
+	// Put a breakpoint on the last tool.
+	Tools bool `yaml:"tools"`
+	// Number of breakpoints to place in the conversation history. Zero
+	// leaves the client's message breakpoints alone.
+	Messages int `yaml:"messages"`
+	// Earlier message breakpoints snap to multiples of this many messages.
+	StableInterval int            `yaml:"stable_interval"`
+	TTL            CacheTTLConfig `yaml:"ttl"`
+}
+
+func defaultConfig() Config {
+	models := []string{"claude-sonnet-4*", "claude-opus-4*"}
+	return Config{
+		Addr:                "localhost",
+		Port:                "8080",
+		CacheReportInterval: 5 * time.Minute,
+		TokenCache: TokenCacheConfig{
+			MaxEntries:      10000,
+			MaxBytes:        8 << 20,
+			TTL:             24 * time.Hour,
+			ReportInterval:  5 * time.Minute,
+			CoalesceTimeout: 30 * time.Second,
+		},
+		TokenCount: TokenCountConfig{Mode: tokenCountUpstream},
+		Ollama:     OllamaConfig{Timeout: 2 * time.Minute},
+		Log:        LogConfig{Format: logFormatConsole, Level: "info"},
+		Capture:    CaptureConfig{Sample: 1, MaxBodyBytes: 4 << 20, Retention: 7 * 24 * time.Hour},
+		ResponseCache: ResponseCacheConfig{
+			TTL:        time.Hour,
+			MaxEntries: 1000,
+		},
+		Transforms: TransformsConfig{
+			Temperature: TemperatureConfig{
+				TransformConfig: TransformConfig{Enabled: true, Models: models},
+				Value:           0.1,
+			},
+			UserPrompt: UserPromptConfig{
+				TransformConfig: TransformConfig{Enabled: true, Models: models},
+				Template:        "assets/user_prompt.txt",
+			},
+			SystemPrompt: SystemPromptConfig{
+				TransformConfig: TransformConfig{Enabled: true, Models: models},
+				File:            "assets/system_prompt.txt",
+			},
+			Tools: ToolsConfig{
+				TransformConfig:      TransformConfig{Enabled: true, Models: models},
+				MaxDescriptionLength: 5000,
+				Descriptions: map[string]string{
+					"Bash":      "assets/tool_bash_description.txt",
+					"TodoWrite": "assets/tool_todowrite_description.txt",
+				},
+				Remove: []string{"NotebookRead", "NotebookEdit"},
+			},
+			CacheControl: CacheControlConfig{
+				TransformConfig: TransformConfig{Enabled: true, Models: models},
+				Tools:           true,
+				Messages:        2,
+				StableInterval:  10,
+				TTL: CacheTTLConfig{
+					Tools:         cacheTTL5m,
+					System:        cacheTTL5m,
+					Messages:      cacheTTL5m,
+					IdleThreshold: 5 * time.Minute,
+				},
+			},
+		},
+	}
+}
+
+// loadConfig returns the default config overlaid with the YAML file at path.
+// Keys missing from the file keep their default values; unknown keys are
+// rejected so that typos don't silently disable a transformation.
+func loadConfig(path string) (Config, error) {
+	config := defaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (c Config) validate() error {
+	if c.Target == "" {
+		return errors.New("target URL is required. Use -target flag or the target key")
+	}
+	if c.RootDir == "" {
+		return errors.New("root directory is required. Use -root-dir flag or the root_dir key")
+	}
+	for _, tc := range []TransformConfig{
+		c.Transforms.Temperature.TransformConfig,
+		c.Transforms.UserPrompt.TransformConfig,
+		c.Transforms.SystemPrompt.TransformConfig,
+		c.Transforms.Tools.TransformConfig,
+		c.Transforms.CacheControl.TransformConfig,
+	} {
+		if err := validateModelPatterns(tc.Models); err != nil {
+			return err
+		}
+	}
+	if cc := c.Transforms.CacheControl; cc.Messages < 0 || cc.Messages > maxCacheBreakpoints || cc.StableInterval < 0 {
+		return fmt.Errorf("transforms.cache_control: messages must be between 0 and %d and stable_interval not negative", maxCacheBreakpoints)
+	}
+	if err := c.Transforms.CacheControl.TTL.validate(); err != nil {
+		return fmt.Errorf("transforms.cache_control.ttl: %w", err)
+	}
+	if err := c.TokenCache.validate(); err != nil {
+		return err
+	}
+	if err := c.TokenCount.validate(); err != nil {
+		return err
+	}
+	if err := c.ResponseCache.validate(); err != nil {
+		return err
+	}
+	if err := c.Ollama.validate(); err != nil {
+		return err
+	}
+	if err := c.Log.validate(); err != nil {
+		return err
+	}
+	if err := c.Capture.validate(); err != nil {
+		return err
+	}
+	if err := c.Redact.validate(); err != nil {
+		return err
+	}
+	for i, rule := range c.CannedResponses {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("canned_responses[%d] %s: %w", i, rule.Name, err)
+		}
+	}
+	for name, tc := range c.Transforms.Custom {
+		// Custom entries share the transforms section with the built-in
+		// keys, so a misspelled built-in ends up here.
+		if !isRegisteredTransformer(name) {
+			return fmt.Errorf("transforms.%s: no transformer of that name is registered", name)
+		}
+		if err := validateModelPatterns(tc.Models); err != nil {
+			return fmt.Errorf("transforms.%s: %w", name, err)
+		}
+	}
+	for _, rule := range c.ModelSettings {
+		if len(rule.Models) == 0 {
+			return errors.New("every model_settings entry needs at least one model pattern")
+		}
+		if err := validateModelPatterns(rule.Models); err != nil {
+			return err
+		}
+	}
+	for _, price := range c.Prices {
+		if err := validateModelPatterns(price.Models); err != nil {
+			return err
+		}
+	}
+	for _, rule := range c.ModelRewrites {
+		if len(rule.Models) == 0 || rule.To == "" {
+			return errors.New("every model_rewrites entry needs model patterns and a target model")
+		}
+		if err := validateModelPatterns(rule.Models); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
-	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,96 +19,238 @@ const (
 	colorGreen  = "\033[32m"
 	colorRed    = "\033[31m"
 	colorYellow = "\033[33m"
+	colorDim    = "\033[2m"
 )
 
-func printBlue(format string, args ...interface{}) {
-	fmt.Printf(colorBlue+format+colorReset, args...)
+// Log formats.
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+)
+
+// LogConfig selects how the booster logs.
+type LogConfig struct {
+	// console for colored lines meant for a terminal, json for one JSON
+	// object per line. Only read at startup.
+	Format string `yaml:"format"`
+	// debug, info, warn or error.
+	Level string `yaml:"level"`
 }
 
-func printGreen(format string, args ...interface{}) {
-	fmt.Printf(colorGreen+format+colorReset, args...)
+func (c LogConfig) validate() error {
+	if c.Format != logFormatConsole && c.Format != logFormatJSON {
+		return fmt.Errorf("log: invalid format %q, must be console or json", c.Format)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("log: invalid level %q", c.Level)
+	}
+	return nil
 }
 
-func printRed(format string, args ...interface{}) {
-	fmt.Printf(colorRed+format+colorReset, args...)
+var (
+	logLevel = new(slog.LevelVar)
+	logger   = slog.New(&requestFieldsHandler{&redactHandler{newConsoleHandler(os.Stdout, logLevel)}})
+)
+
+// setupLogging installs the logger described by c. It also becomes the
+// default logger, so the standard log package writes through it too. Secrets
+// are redacted from every line.
+func setupLogging(c LogConfig) {
+	setLogLevel(c.Level)
+
+	var handler slog.Handler
+	if c.Format == logFormatJSON {
+		handler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+			Level: logLevel,
+			ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+				if a.Key == colorKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		})
+	} else {
+		handler = newConsoleHandler(os.Stdout, logLevel)
+	}
+	logger = slog.New(&requestFieldsHandler{&redactHandler{handler}})
+	slog.SetDefault(logger)
 }
 
-func printYellow(format string, args ...interface{}) {
-	fmt.Printf(colorYellow+format+colorReset, args...)
+// setLogLevel changes the level of the running logger. The level has been
+// validated with the rest of the config.
+func setLogLevel(level string) {
+	var l slog.Level
+	l.UnmarshalText([]byte(level))
+	logLevel.Set(l)
 }
 
-func logRequest(r *http.Request) {
-	printBlue("→ %s %s %s\n", r.Method, r.RequestURI, r.Proto)
+// colorKey carries the color of a console line. Other handlers drop it.
+const colorKey = "_color"
 
-	return
-	// Log headers
-	for name, values := range r.Header {
-		for _, value := range values {
-			printBlue("%s: %s\n", name, value)
-		}
+// logAttrs logs msg with the fields of the request in ctx, if any, and
+// attrs. color overrides the console color picked by level.
+func logAttrs(ctx context.Context, level slog.Level, color, msg string, attrs ...slog.Attr) {
+	if color != "" {
+		attrs = append(attrs, slog.String(colorKey, color))
 	}
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
 
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		printRed("Error reading request body: %v\n", err)
+// logf formats a message and logs it like logAttrs. Pass the request's
+// context on the request path so the line carries its fields, and
+// context.Background() everywhere else.
+func logf(ctx context.Context, level slog.Level, color, format string, args ...interface{}) {
+	if !logger.Enabled(ctx, level) {
 		return
 	}
-	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-	// printBlue("\nBody:\n%s\n", string(bodyBytes))
+	logAttrs(ctx, level, color, fmt.Sprintf(strings.TrimSuffix(format, "\n"), args...))
+}
 
-	// Write request body to file
-	writeToFile(bodyBytes, "claude_june10")
+func printBlue(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, slog.LevelInfo, colorBlue, format, args...)
 }
 
-func writeToFile(bodyBytes []byte, prefix string) {
-	filename, err := generateRandomFilename(prefix)
-	if err != nil {
-		printRed("Error generating filename: %v\n", err)
-		return
-	}
-	err = os.WriteFile(filename, bodyBytes, 0644)
-	if err != nil {
-		printRed("Error writing request to file: %v\n", err)
-		return
+func printGreen(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, slog.LevelInfo, colorGreen, format, args...)
+}
+
+func printRed(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, slog.LevelError, colorRed, format, args...)
+}
+
+func printYellow(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, slog.LevelInfo, colorYellow, format, args...)
+}
+
+func printWarning(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, slog.LevelWarn, colorYellow, format, args...)
+}
+
+func printDebug(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, slog.LevelDebug, colorDim, format, args...)
+}
+
+// requestFieldsHandler adds the request ID, path and model of the request
+// being handled to every record logged with its context.
+type requestFieldsHandler struct {
+	slog.Handler
+}
+
+func (h *requestFieldsHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info, ok := getRequestInfoFromContext(ctx); ok {
+		info.mu.Lock()
+		model := info.model
+		info.mu.Unlock()
+
+		r.AddAttrs(slog.String("request_id", info.id), slog.String("path", info.path))
+		if model != "" {
+			r.AddAttrs(slog.String("model", string(model)))
+		}
 	}
-	printYellow("Request body saved to: %s\n", filename)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *requestFieldsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &requestFieldsHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *requestFieldsHandler) WithGroup(name string) slog.Handler {
+	return &requestFieldsHandler{h.Handler.WithGroup(name)}
+}
+
+// consoleHandler writes one colored line per record: the message followed
+// by its fields as key=value pairs.
+type consoleHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	attrs []slog.Attr
+}
+
+func newConsoleHandler(w io.Writer, level slog.Leveler) *consoleHandler {
+	return &consoleHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
 }
 
-func generateRandomFilename(prefix string) (string, error) {
-	bytes := make([]byte, 8)
-	_, err := rand.Read(bytes)
-	if err != nil {
-		return "", err
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	color := ""
+	switch {
+	case r.Level >= slog.LevelError:
+		color = colorRed
+	case r.Level >= slog.LevelWarn:
+		color = colorYellow
+	case r.Level < slog.LevelInfo:
+		color = colorDim
+	}
+
+	var fields strings.Builder
+	appendAttr := func(a slog.Attr) bool {
+		if a.Key == colorKey {
+			color = a.Value.String()
+		} else if a.Key != "" {
+			fmt.Fprintf(&fields, " %s=%v", a.Key, a.Value)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		appendAttr(a)
+	}
+	r.Attrs(appendAttr)
+
+	line := r.Message
+	if fields.Len() > 0 {
+		line += colorDim + fields.String() + colorReset
+	}
+	if color != "" {
+		line = color + line + colorReset
 	}
-	filename := fmt.Sprintf("%s_%x.txt", prefix, bytes)
-	return filepath.Join(os.TempDir(), filename), nil
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line+"\n")
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(slices.Clip(h.attrs), attrs...)
+	return &h2
+}
+
+// Groups aren't used by the booster, so they are flattened away.
+func (h *consoleHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func logRequest(r *http.Request) {
+	logAttrs(r.Context(), slog.LevelInfo, colorBlue, fmt.Sprintf("→ %s %s %s", r.Method, r.RequestURI, r.Proto),
+		slog.String("method", r.Method))
 }
 
 func logResponse(w *responseLogger, r *http.Request) {
-	if w.statusCode == http.StatusOK {
-		printGreen("← %d %s\n", w.statusCode, http.StatusText(w.statusCode))
-	} else {
-		printRed("← %d %s\n", w.statusCode, http.StatusText(w.statusCode))
+	level, color := slog.LevelInfo, colorGreen
+	if w.statusCode != http.StatusOK {
+		level, color = slog.LevelError, colorRed
+	}
+	attrs := []slog.Attr{slog.Int("status", w.statusCode)}
+	if info, ok := getRequestInfoFromContext(r.Context()); ok {
+		attrs = append(attrs, slog.Int64("latency_ms", time.Since(info.start).Milliseconds()))
 	}
+	logAttrs(r.Context(), level, color, fmt.Sprintf("← %d %s", w.statusCode, http.StatusText(w.statusCode)), attrs...)
 
 	// Check if this is a token count response that needs caching
+	estimate, estimated := getTokenEstimateFromContext(r.Context())
+	if estimated && !estimate.local && w.statusCode == http.StatusOK {
+		learnFromTokenCount(estimate, w.body.Bytes())
+	}
 	if hash, ok := getCacheHashFromContext(r.Context()); ok {
-		if w.statusCode == http.StatusOK && w.body.Len() > 0 {
+		if w.statusCode == http.StatusOK && w.body.Len() > 0 && !(estimated && estimate.local) {
 			globalTokenCache.set(hash, w.body.Bytes())
-			printYellow("Cached token count response with hash: %s\n", hash[:8]+"...")
-		}
-	}
-
-	return
-	// Log response headers
-	for name, values := range w.Header() {
-		for _, value := range values {
-			printGreen("%s: %s\n", name, value)
+			printDebug(r.Context(), "Cached token count response with hash: %s\n", hash[:8]+"...")
 		}
 	}
-
-	// Log response body
-	if w.body.Len() > 0 {
-		printGreen("\nBody:\n%s\n", w.body.String())
-	}
 }
@@ -2,28 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
-	"text/template"
+	"syscall"
+	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
 )
 
-type Config struct {
-	SuppressHaiku bool
-	Temperature   float64
-	RootDir       string
-}
-
 type TemplateData struct {
 	UserPrivate    string
 	ProjectPrivate string
@@ -31,75 +30,170 @@ type TemplateData struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", "", "Path to a YAML config file")
 	targetURL := flag.String("target", "", "Target URL to proxy to (required)")
 	listenAddr := flag.String("addr", "localhost", "Listen address")
 	listenPort := flag.String("port", "8080", "Listen port")
 	suppressHaiku := flag.Bool("suppress-haiku", false, "Enable haiku generation suppression")
-	temperature := flag.Float64("temperature", 0.1, "Temperature for Claude Sonnet 4 requests")
+	temperature := flag.Float64("temperature", 0.1, "Temperature for requests matched by the temperature transform")
 	rootDir := flag.String("root-dir", "", "Root directory for project files (required)")
+	rawTokenCount := flag.Bool("raw-token-count", false, "Forward count_tokens requests without running the transformers")
+	logFormat := flag.String("log-format", "console", "Log format: console or json")
+	logLevelName := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	captureDir := flag.String("capture-dir", "", "Directory to archive requests and responses in")
+	captureSample := flag.Float64("capture-sample", 1, "Share of requests to capture, from 0 to 1")
+	captureMaxBodyBytes := flag.Int("capture-max-body-bytes", 4<<20, "Cut captured bodies off at this size, 0 for no limit")
+	captureRetention := flag.Duration("capture-retention", 7*24*time.Hour, "Delete captures older than this, 0 to keep them forever")
+	diff := flag.Bool("diff", false, "Log what the booster changed in each request")
 	flag.Parse()
 
-	config := Config{
-		SuppressHaiku: *suppressHaiku,
-		Temperature:   *temperature,
-		RootDir:       *rootDir,
+	// Flags given explicitly on the command line win over the config file.
+	var setFlags []string
+	flag.Visit(func(f *flag.Flag) { setFlags = append(setFlags, f.Name) })
+	overrides := func(config *Config) {
+		for _, name := range setFlags {
+			switch name {
+			case "target":
+				config.Target = *targetURL
+			case "addr":
+				config.Addr = *listenAddr
+			case "port":
+				config.Port = *listenPort
+			case "suppress-haiku":
+				config.SuppressHaiku = *suppressHaiku
+			case "temperature":
+				config.Transforms.Temperature.Value = *temperature
+			case "root-dir":
+				config.RootDir = *rootDir
+			case "raw-token-count":
+				config.TokenCount.Raw = *rawTokenCount
+			case "log-format":
+				config.Log.Format = *logFormat
+			case "log-level":
+				config.Log.Level = *logLevelName
+			case "capture-dir":
+				config.Capture.Dir = *captureDir
+			case "capture-sample":
+				config.Capture.Sample = *captureSample
+			case "capture-max-body-bytes":
+				config.Capture.MaxBodyBytes = *captureMaxBodyBytes
+			case "capture-retention":
+				config.Capture.Retention = *captureRetention
+			case "diff":
+				config.Diff = *diff
+			}
+		}
 	}
 
-	if *targetURL == "" {
-		log.Fatal("Target URL is required. Use -target flag.")
-	}
-	if *rootDir == "" {
-		log.Fatal("Root directory is required. Use -root-dir flag.")
+	reloader := newReloader(*configPath, overrides)
+	if err := reloader.init(); err != nil {
+		log.Fatal(err)
 	}
+	setupLogging(liveState.Load().config.Log)
+	warnUnmatchedModels(liveState.Load().config)
+	go reloader.watch()
 
-	target, err := url.Parse(*targetURL)
-	if err != nil {
-		log.Fatalf("Invalid target URL: %v", err)
+	if dir := liveState.Load().config.TokenCache.Dir; dir != "" {
+		if err := globalTokenCache.open(dir); err != nil {
+			printRed(context.Background(), "Error opening token count cache in %s, keeping it in memory only: %v\n", dir, err)
+		}
+		if err := loadTokenCalibration(dir); err != nil {
+			printRed(context.Background(), "Error loading token count calibration from %s: %v\n", dir, err)
+		}
+		go saveTokenCalibrationPeriodically()
 	}
 
+	// Load the tokenizer now rather than on the first count_tokens request
+	go localTokenizer()
+
 	proxy := &httputil.ReverseProxy{
 		Rewrite: func(r *httputil.ProxyRequest) {
-			r.SetURL(target)
+			r.SetURL(liveState.Load().target)
 		},
+		ModifyResponse: interceptResponse,
 	}
 
 	// Add logging middleware
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := liveState.Load()
+		info := newRequestInfo(r)
+		r = r.WithContext(addRequestInfoToContext(r.Context(), info))
 		logRequest(r)
+		startCapture(r, state)
+
+		// Capture response
+		responseWriter := &responseLogger{ResponseWriter: w}
+		defer finishCapture(responseWriter, r)
 
 		// Check if this is an Anthropic API request that needs special handling
+		proxied := false
 		if r.Method == "POST" {
 			switch r.URL.Path {
 			case "/v1/messages":
-				if handleMessage(r, w, config) {
+				if handleMessage(r, responseWriter, state) {
 					return // Response already written
 				}
 			case "/v1/messages/count_tokens":
-				if handleTokenCount(r, w) {
+				if handleTokenCount(r, responseWriter, state) {
 					return // Response already written
 				}
+				// Deferred so waiting requests are released even if the
+				// proxy panics, e.g. because the client went away
+				defer func() { finishTokenCountFlight(responseWriter, r, proxied) }()
 			}
 		}
 
-		// Capture response
-		responseWriter := &responseLogger{ResponseWriter: w}
 		proxy.ServeHTTP(responseWriter, r)
+		proxied = true
 		logResponse(responseWriter, r)
+		logUsage(r.Context(), info, state.config)
 	})
 
-	listenAddress := *listenAddr + ":" + *listenPort
-	log.Printf("Starting reverse proxy on %s, forwarding to %s", listenAddress, *targetURL)
+	go reportCacheStatsPeriodically(func() time.Duration {
+		return liveState.Load().config.CacheReportInterval
+	})
+	go reportTokenCacheStatsPeriodically(globalTokenCache)
+	go pruneCapturesPeriodically()
+
+	config := liveState.Load().config
+	listenAddress := config.Addr + ":" + config.Port
+	printBlue(context.Background(), "Starting reverse proxy on %s, forwarding to %s\n", listenAddress, config.Target)
+
+	server := &http.Server{Addr: listenAddress, Handler: handler}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			printRed(context.Background(), "Error draining in-flight requests: %v\n", err)
+		}
+	}()
 
-	err = http.ListenAndServe(listenAddress, handler)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+	// ListenAndServe returns as soon as Shutdown starts, so wait for the
+	// in-flight requests to drain before reporting.
+	<-shutdownDone
+	flushTokenCalibration()
+	printCacheReport("Prompt cache summary")
 }
 
 type responseLogger struct {
 	http.ResponseWriter
 	statusCode int
 	body       bytes.Buffer
+	firstByte  time.Time
 }
 
 func (r *responseLogger) WriteHeader(statusCode int) {
@@ -108,102 +202,153 @@ func (r *responseLogger) WriteHeader(statusCode int) {
 }
 
 func (r *responseLogger) Write(body []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	if r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
 	r.body.Write(body)
 	return r.ResponseWriter.Write(body)
 }
 
-func handleMessage(r *http.Request, w http.ResponseWriter, config Config) bool {
+// Flush lets the reverse proxy push streamed events to the client as they
+// arrive instead of when the buffer fills up.
+func (r *responseLogger) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseLogger) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func handleMessage(r *http.Request, w http.ResponseWriter, state *runtimeState) bool {
 	// Read the request body
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		printRed("Error reading request body: %v\n", err)
+		printRed(r.Context(), "Error reading request body: %v\n", err)
 		return false
 	}
 
 	// Parse into MessageNewParams
-	var params anthropic.BetaMessageNewParams
-	err = json.Unmarshal(bodyBytes, &params)
+	params, err := parseMessageParams(bodyBytes)
 	if err != nil {
-		printRed("Error parsing MessageNewParams: %v\n", err)
+		printRed(r.Context(), "Error parsing MessageNewParams: %v\n", err)
 		return false
 	}
 
-	// Check if we should suppress Haiku generation
-	if config.SuppressHaiku && suppressHaikuGeneration(&params, w) {
+	if info, ok := getRequestInfoFromContext(r.Context()); ok {
+		info.mu.Lock()
+		info.session = sessionFromUserID(params.Metadata.UserID.Value)
+		info.model = params.Model
+		info.mu.Unlock()
+	}
+
+	// Answer throwaway side calls without going upstream
+	if answerCannedResponse(r, &params, w, state) {
+		return true
+	}
+	if routeToOllama(r, &params, w, state) {
 		return true
 	}
 
-	if params.Model == anthropic.ModelClaudeSonnet4_20250514 {
-		// Log basic information about the parsed request
-		// printYellow("Successfully parsed Anthropic request:\n")
-		// printYellow("  Max Tokens: %d\n", params.MaxTokens)
-		// printYellow("  Messages count: %d\n", len(params.Messages))
-		// printYellow("  Tools count: %d\n", len(params.Tools))
+	// Keep the client's version of the request to diff against
+	_, capturing := getCaptureFromContext(r.Context())
+	wantDiff := state.config.Diff || capturing
+	var original anthropic.BetaMessageNewParams
+	if wantDiff {
+		original, _ = parseMessageParams(bodyBytes)
 	}
 
+	modelRewritten := rewriteModel(r, &params, state.config)
+	warnUnmatchedModel(r.Context(), state.config, params.Model)
+
 	// Process modifications
-	bodyModified := setTemperature(&params, config)
-	bodyModified = setUserPrompt(&params, config) || bodyModified
-	bodyModified = setSystemPrompt(&params) || bodyModified
-	bodyModified = filterTools(&params) || bodyModified
-	// This should be the last.
-	bodyModified = alterCacheControl(&params) || bodyModified
+	bodyModified := runTransformers(&transformContext{
+		params:  &params,
+		state:   state,
+		request: r,
+	})
+	bodyModified = bodyModified || modelRewritten
 
 	// Marshal and set body if any modifications were made
 	if bodyModified {
 		modifiedBody, err := json.Marshal(params)
 		if err != nil {
-			printRed("Error marshaling modified request: %v\n", err)
+			printRed(r.Context(), "Error marshaling modified request: %v\n", err)
 			return false
 		}
 
-		// writeToFile(modifiedBody, "june13")
+		bodyBytes = modifiedBody
+		captureTransformedRequest(r, modifiedBody)
 
-		r.Body = io.NopCloser(bytes.NewReader(modifiedBody))
+		if wantDiff {
+			changes := diffRequests(&original, &params)
+			if state.config.Diff {
+				logRequestDiff(r.Context(), changes)
+			}
+			captureRequestDiff(r, changes)
+		}
 		r.ContentLength = int64(len(modifiedBody))
 		r.Header.Set("Content-Length", strconv.Itoa(len(modifiedBody)))
-	} else {
-		// Restore original body if no modifications
-		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 	}
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 
-	return false
+	return serveCachedResponse(r, w, state, &params, bodyBytes)
 }
 
-func setTemperature(params *anthropic.BetaMessageNewParams, config Config) bool {
-	if params.Model != anthropic.ModelClaudeSonnet4_20250514 {
-		return false
+func parseMessageParams(bodyBytes []byte) (anthropic.BetaMessageNewParams, error) {
+	var params anthropic.BetaMessageNewParams
+	if err := json.Unmarshal(bodyBytes, &params); err != nil {
+		return params, err
+	}
+	// The SDK leaves stream out of the params struct, so carry it over by
+	// hand or a re-marshaled body would turn into a non-streaming request.
+	var streamField struct {
+		Stream *bool `json:"stream"`
+	}
+	if json.Unmarshal(bodyBytes, &streamField) == nil && streamField.Stream != nil {
+		params.SetExtraFields(map[string]any{"stream": *streamField.Stream})
 	}
+	return params, nil
+}
+
+func setTemperature(tc *transformContext) bool {
+	params := tc.params
 
 	// We can't override temperature when thinking is enabled.
 	if thinking := params.Thinking.OfEnabled; thinking != nil && thinking.Type == "enabled" {
 		return false
 	}
 
-	params.Temperature = anthropic.Float(config.Temperature)
+	value := tc.transforms.Temperature.Value
+	params.Temperature = anthropic.Float(value)
+	tc.notef("temperature set to %g", value)
 	return true
 }
 
-func setUserPrompt(params *anthropic.BetaMessageNewParams, config Config) bool {
-	if params.Model != anthropic.ModelClaudeSonnet4_20250514 {
-		return false
-	}
+func setUserPrompt(tc *transformContext) bool {
+	params, state := tc.params, tc.state
 
-	if len(params.Messages[0].Content) > 0 {
+	if len(params.Messages) > 0 && len(params.Messages[0].Content) > 0 {
 		if ptr := params.Messages[0].Content[0].GetText(); ptr != nil {
 			txt := *ptr
 
 			if strings.HasPrefix(txt, "<system-reminder>") {
 				// Load template data
-				templateData := loadTemplateData(config.RootDir)
+				templateData := loadTemplateData(tc.request.Context(), state.config.RootDir)
 
 				// Process template
-				processedText, err := processTemplate("assets/user_prompt.txt", templateData)
+				templatePath := tc.transforms.UserPrompt.Template
+				processedText, err := processTemplate(state.prompts, templatePath, templateData)
 				if err != nil {
-					printRed("Error processing user_prompt.txt template: %v\n", err)
+					printRed(tc.request.Context(), "Error processing %s template: %v\n", templatePath, err)
 					return false
 				}
 				*ptr = processedText
+				tc.notef("first user message replaced with %s", templatePath)
 				return true
 			}
 		}
@@ -212,16 +357,15 @@ func setUserPrompt(params *anthropic.BetaMessageNewParams, config Config) bool {
 	return false
 }
 
-func setSystemPrompt(params *anthropic.BetaMessageNewParams) bool {
-	if params.Model != anthropic.ModelClaudeSonnet4_20250514 {
-		return false
-	}
+func setSystemPrompt(tc *transformContext) bool {
+	params, state := tc.params, tc.state
 
 	if len(params.System) > 0 {
 		// Read system prompt from file
-		systemPromptText, err := os.ReadFile("assets/system_prompt.txt")
-		if err != nil {
-			printRed("Error reading system_prompt.txt: %v\n", err)
+		filename := tc.transforms.SystemPrompt.File
+		systemPromptText, ok := state.prompts.text(filename)
+		if !ok {
+			printRed(tc.request.Context(), "System prompt %s is not loaded\n", filename)
 			return false
 		}
 
@@ -233,66 +377,21 @@ func setSystemPrompt(params *anthropic.BetaMessageNewParams) bool {
 				// CacheControl: anthropic.NewBetaCacheControlEphemeralParam(),
 			},
 			{
-				Text:         string(systemPromptText),
+				Text:         systemPromptText,
 				CacheControl: anthropic.NewBetaCacheControlEphemeralParam(),
 			},
 		}
+		tc.notef("system prompt replaced with %s", filename)
 		return true
 	}
 
 	return false
 }
 
-func alterCacheControl(params *anthropic.BetaMessageNewParams) bool {
-	if params.Model != anthropic.ModelClaudeSonnet4_20250514 || len(params.Tools) == 0 {
-		return false
-	}
-
-	// Set cache control on the last tool to ephemeral
-	lastIndex := len(params.Tools) - 1
-	lastTool := params.Tools[lastIndex]
-
-	cacheControl := anthropic.NewBetaCacheControlEphemeralParam()
-
-	// Check all possible tool types and set cache control
-	// TODO: need to find a better way to achieve this.
-	if lastTool.OfTool != nil {
-		lastTool.OfTool.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfComputerUseTool20241022 != nil {
-		lastTool.OfComputerUseTool20241022.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfBashTool20241022 != nil {
-		lastTool.OfBashTool20241022.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfTextEditor20241022 != nil {
-		lastTool.OfTextEditor20241022.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfComputerUseTool20250124 != nil {
-		lastTool.OfComputerUseTool20250124.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfBashTool20250124 != nil {
-		lastTool.OfBashTool20250124.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfTextEditor20250124 != nil {
-		lastTool.OfTextEditor20250124.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfTextEditor20250429 != nil {
-		lastTool.OfTextEditor20250429.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfWebSearchTool20250305 != nil {
-		lastTool.OfWebSearchTool20250305.CacheControl = cacheControl
-		return true
-	} else if lastTool.OfCodeExecutionTool20250522 != nil {
-		lastTool.OfCodeExecutionTool20250522.CacheControl = cacheControl
-		return true
-	}
-
-	return false
-}
-
-func filterTools(params *anthropic.BetaMessageNewParams) bool {
-	if params.Model != anthropic.ModelClaudeSonnet4_20250514 || len(params.Tools) == 0 {
+func filterTools(tc *transformContext) bool {
+	params, state := tc.params, tc.state
+	toolsConfig := tc.transforms.Tools
+	if len(params.Tools) == 0 {
 		return false
 	}
 
@@ -300,45 +399,40 @@ func filterTools(params *anthropic.BetaMessageNewParams) bool {
 	// Replace long tool descriptions with shorter ones
 	for _, tool := range params.Tools {
 		name := *tool.GetName()
-		if desc := tool.GetDescription(); desc != nil && len(*desc) > 5000 {
-			printYellow("Tool '%s' has long description (%d chars), replacing...\n", name, len(*desc))
-
-			var filename string
-			switch name {
-			case "Bash":
-				filename = "assets/tool_bash_description.txt"
-			case "TodoWrite":
-				filename = "assets/tool_todowrite_description.txt"
-			default:
+		if desc := tool.GetDescription(); desc != nil && len(*desc) > toolsConfig.MaxDescriptionLength {
+			filename, ok := toolsConfig.Descriptions[name]
+			if !ok {
 				continue
 			}
 
-			newDesc, err := os.ReadFile(filename)
-			if err != nil {
-				printRed("Error reading %s: %v\n", filename, err)
+			newDesc, ok := state.prompts.text(filename)
+			if !ok {
+				printRed(tc.request.Context(), "Tool description %s is not loaded\n", filename)
 				continue
 			}
 
+			oldLen := len(*desc)
 			// GetDescription != nil, means OfTool is not nil
-			tool.OfTool.Description = anthropic.String(string(newDesc))
+			tool.OfTool.Description = anthropic.String(newDesc)
+			tc.notef("tool '%s' description replaced (%d -> %d chars)", name, oldLen, len(newDesc))
 
 			toolsModified = true
 		}
 	}
 
-	// Filter out NotebookRead and NotebookEdit tools
+	// Filter out unwanted tools
 	originalLen := len(params.Tools)
 	filtered := params.Tools[:0]
 	for _, tool := range params.Tools {
 		name := *tool.GetName()
-		if name != "NotebookRead" && name != "NotebookEdit" {
+		if !slices.Contains(toolsConfig.Remove, name) {
 			filtered = append(filtered, tool)
 		}
 	}
 
 	// If tools were filtered, update params
 	if len(filtered) != originalLen {
-		printYellow("Filtered out %d/%d tools.\n", originalLen-len(filtered), originalLen)
+		tc.notef("filtered out %d/%d tools", originalLen-len(filtered), originalLen)
 		params.Tools = filtered
 		toolsModified = true
 	}
@@ -346,23 +440,31 @@ func filterTools(params *anthropic.BetaMessageNewParams) bool {
 	return toolsModified
 }
 
-func handleTokenCount(r *http.Request, w http.ResponseWriter) bool {
+func handleTokenCount(r *http.Request, w http.ResponseWriter, state *runtimeState) bool {
 	// Read the request body
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		printRed("Error reading token count request body: %v\n", err)
+		printRed(r.Context(), "Error reading token count request body: %v\n", err)
 		return false
 	}
 
+	// Count what handleMessage would actually send
+	if !state.config.TokenCount.Raw {
+		bodyBytes = transformTokenCountBody(r, bodyBytes, state)
+		captureTransformedRequest(r, bodyBytes)
+	}
+
 	// Restore the body for potential forwarding
 	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	r.ContentLength = int64(len(bodyBytes))
+	r.Header.Set("Content-Length", strconv.Itoa(len(bodyBytes)))
 
 	// Generate hash for cache key
-	hash := hashRequestBody(bodyBytes)
+	hash := hashTokenCountRequest(r.Context(), bodyBytes)
 
 	// Check if we have a cached response
 	if cachedResponse, exists := globalTokenCache.get(hash); exists {
-		printGreen("Token count cache hit! Returning cached response\n")
+		printGreen(r.Context(), "Token count cache hit! Returning cached response\n")
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Content-Length", strconv.Itoa(len(cachedResponse)))
 		w.WriteHeader(http.StatusOK)
@@ -370,64 +472,131 @@ func handleTokenCount(r *http.Request, w http.ResponseWriter) bool {
 		return true
 	}
 
+	// Estimate locally in every mode, to answer with in local mode, to fall
+	// back on in fallback mode and to calibrate against a fresh upstream count
+	mode := state.config.TokenCount.Mode
+	var estimate *tokenEstimate
+	if model, raw, err := estimateTokens(bodyBytes); err != nil {
+		printRed(r.Context(), "Error estimating tokens locally: %v\n", err)
+	} else {
+		estimate = &tokenEstimate{model: model, raw: raw, fallback: mode == tokenCountFallback}
+	}
+
+	if estimate != nil {
+		if mode == tokenCountLocal {
+			body := estimate.body()
+			printGreen(r.Context(), "Token count answered locally: %s\n", body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(body)
+			return true
+		}
+		*r = *r.WithContext(addTokenEstimateToContext(r.Context(), estimate))
+	}
+
+	// Wait for an identical request already on its way upstream
+	if timeout := state.config.TokenCache.CoalesceTimeout; timeout > 0 {
+		if f, leader := tokenCountFlights.join(hash); !leader {
+			printDebug(r.Context(), "Identical token count request in flight, waiting for its response\n")
+			if f.wait(timeout) {
+				if f.statusCode == http.StatusOK {
+					printGreen(r.Context(), "Token count answered by identical request in flight\n")
+				} else {
+					printRed(r.Context(), "Identical token count request in flight failed: %d %s\n", f.statusCode, http.StatusText(f.statusCode))
+				}
+				f.writeTo(w)
+				return true
+			}
+			printYellow(r.Context(), "No response from identical token count request, forwarding\n")
+		}
+	}
+
 	// Cache miss - add hash to context for response caching
-	printYellow("Token count cache miss. Request will be forwarded and response cached\n")
+	printYellow(r.Context(), "Token count cache miss. Request will be forwarded and response cached\n")
 	ctx := addCacheHashToContext(r.Context(), hash)
 	*r = *r.WithContext(ctx)
 
 	return false
 }
 
-func loadFileContent(filePath string) string {
+// transformTokenCountBody runs the transformers that apply to count_tokens
+// requests and returns the rewritten body, or the original one if nothing
+// changed. The params marshal fields count_tokens rejects, such as
+// max_tokens, so only the fields it accepts are kept.
+func transformTokenCountBody(r *http.Request, bodyBytes []byte, state *runtimeState) []byte {
+	params, err := parseMessageParams(bodyBytes)
+	if err != nil {
+		printRed(r.Context(), "Error parsing token count request: %v\n", err)
+		return bodyBytes
+	}
+
+	modelRewritten := rewriteModel(r, &params, state.config)
+	bodyModified := runTransformers(&transformContext{
+		params:  &params,
+		state:   state,
+		request: r,
+	})
+	if !bodyModified && !modelRewritten {
+		return bodyBytes
+	}
+
+	modifiedBody, err := json.Marshal(params)
+	if err == nil {
+		modifiedBody, err = canonicalizeRequest(modifiedBody, tokenCountFields)
+	}
+	if err != nil {
+		printRed(r.Context(), "Error marshaling modified token count request: %v\n", err)
+		return bodyBytes
+	}
+	return modifiedBody
+}
+
+func loadFileContent(ctx context.Context, filePath string) string {
 	content, err := os.ReadFile(filePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			// Other errors (permissions, etc.) should be logged
-			printYellow("Warning: Could not read file %s: %v\n", filePath, err)
+			printWarning(ctx, "Could not read file %s: %v\n", filePath, err)
 		}
 		return ""
 	}
 	return string(content)
 }
 
-func loadUserPrivate() string {
+func loadUserPrivate(ctx context.Context) string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		printYellow("Warning: Could not get user home directory: %v\n", err)
+		printWarning(ctx, "Could not get user home directory: %v\n", err)
 		return ""
 	}
-	return loadFileContent(filepath.Join(homeDir, ".claude", "CLAUDE.md"))
+	return loadFileContent(ctx, filepath.Join(homeDir, ".claude", "CLAUDE.md"))
 }
 
-func loadProjectPrivate(rootDir string) string {
-	return loadFileContent(filepath.Join(rootDir, "CLAUDE.local.md"))
+func loadProjectPrivate(ctx context.Context, rootDir string) string {
+	return loadFileContent(ctx, filepath.Join(rootDir, "CLAUDE.local.md"))
 }
 
-func loadProjectPublic(rootDir string) string {
-	return loadFileContent(filepath.Join(rootDir, "CLAUDE.md"))
+func loadProjectPublic(ctx context.Context, rootDir string) string {
+	return loadFileContent(ctx, filepath.Join(rootDir, "CLAUDE.md"))
 }
 
-func loadTemplateData(rootDir string) TemplateData {
+func loadTemplateData(ctx context.Context, rootDir string) TemplateData {
 	return TemplateData{
-		UserPrivate:    loadUserPrivate(),
-		ProjectPrivate: loadProjectPrivate(rootDir),
-		ProjectPublic:  loadProjectPublic(rootDir),
+		UserPrivate:    loadUserPrivate(ctx),
+		ProjectPrivate: loadProjectPrivate(ctx, rootDir),
+		ProjectPublic:  loadProjectPublic(ctx, rootDir),
 	}
 }
 
-func processTemplate(templatePath string, data TemplateData) (string, error) {
-	templateContent, err := os.ReadFile(templatePath)
-	if err != nil {
-		return "", err
-	}
-
-	tmpl, err := template.New("userPrompt").Parse(string(templateContent))
-	if err != nil {
-		return "", err
+func processTemplate(prompts *promptSet, templatePath string, data any) (string, error) {
+	tmpl, ok := prompts.template(templatePath)
+	if !ok {
+		return "", fmt.Errorf("template %s is not loaded", templatePath)
 	}
 
 	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, data)
+	err := tmpl.Execute(&buf, data)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// ModelRewrite sends requests for one model to another, e.g. background
+// Haiku calls to a cheaper model or pinning an alias to a dated snapshot.
+type ModelRewrite struct {
+	Models []string `yaml:"models"`
+	To     string   `yaml:"to"`
+	// Put the requested model back into the response so the client sees
+	// the model it asked for.
+	RewriteResponse bool `yaml:"rewrite_response"`
+}
+
+func (c Config) modelRewriteFor(model anthropic.Model) (ModelRewrite, bool) {
+	for _, rule := range c.ModelRewrites {
+		if matchModel(rule.Models, model) {
+			return rule, true
+		}
+	}
+	return ModelRewrite{}, false
+}
+
+// rewriteModel applies the first matching model_rewrites rule to the request
+// and reports whether the model was changed.
+func rewriteModel(r *http.Request, params *anthropic.BetaMessageNewParams, config Config) bool {
+	rule, ok := config.modelRewriteFor(params.Model)
+	if !ok || params.Model == anthropic.Model(rule.To) {
+		return false
+	}
+
+	printYellow(r.Context(), "Rewriting model %s -> %s\n", params.Model, rule.To)
+	if rule.RewriteResponse {
+		ctx := addOriginalModelToContext(r.Context(), modelSwap{from: params.Model, to: anthropic.Model(rule.To)})
+		*r = *r.WithContext(ctx)
+	}
+	params.Model = anthropic.Model(rule.To)
+	return true
+}
+
+type modelSwap struct {
+	from anthropic.Model // requested by the client
+	to   anthropic.Model // sent upstream
+}
+
+const originalModelKey contextKey = "original_model"
+
+func addOriginalModelToContext(ctx context.Context, swap modelSwap) context.Context {
+	return context.WithValue(ctx, originalModelKey, swap)
+}
+
+func getOriginalModelFromContext(ctx context.Context) (modelSwap, bool) {
+	swap, ok := ctx.Value(originalModelKey).(modelSwap)
+	return swap, ok
+}
+
+// restoreModelTransformer puts the model the client asked for back into the
+// response of a rewritten request. Streams only carry the model in
+// message_start.
+type restoreModelTransformer struct{}
+
+func (restoreModelTransformer) Name() string { return "restore_model" }
+
+func (restoreModelTransformer) Order() int { return 100 }
+
+func (restoreModelTransformer) Applies(rc *responseContext) bool {
+	_, ok := getOriginalModelFromContext(rc.request.Context())
+	return ok
+}
+
+func (restoreModelTransformer) TransformEvent(rc *responseContext, ev *sseEvent) bool {
+	swap, _ := getOriginalModelFromContext(rc.request.Context())
+
+	var payload map[string]any
+	switch ev.Event {
+	case "message_start", "message":
+		if err := ev.decode(&payload); err != nil {
+			printRed(rc.request.Context(), "Error decoding %s event: %v\n", ev.Event, err)
+			return true
+		}
+	default:
+		return true
+	}
+
+	message := payload
+	if ev.Event == "message_start" {
+		message, _ = payload["message"].(map[string]any)
+	}
+	if message == nil || message["model"] != string(swap.to) {
+		return true
+	}
+	message["model"] = string(swap.from)
+
+	if err := ev.encode(payload); err != nil {
+		printRed(rc.request.Context(), "Error encoding %s event: %v\n", ev.Event, err)
+	}
+	return true
+}
+
+func init() {
+	registerResponseTransformer(restoreModelTransformer{})
+}
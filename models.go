@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Model patterns are globs ("claude-sonnet-*", see path.Match) unless
+// wrapped in slashes, in which case they are regular expressions
+// ("/^claude-opus-4(-1)?-/").
+
+var regexpCache sync.Map // pattern -> *regexp.Regexp
+
+func isRegexpPattern(pattern string) bool {
+	return len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+func compileRegexpPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexpCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.Store(pattern, re)
+	return re, nil
+}
+
+func matchModelPattern(pattern string, model anthropic.Model) (bool, error) {
+	if isRegexpPattern(pattern) {
+		re, err := compileRegexpPattern(pattern)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(string(model)), nil
+	}
+	return path.Match(pattern, string(model))
+}
+
+// matchModel reports whether model matches any of the patterns. Invalid
+// patterns never match; they are rejected when the config is validated.
+func matchModel(patterns []string, model anthropic.Model) bool {
+	for _, pattern := range patterns {
+		if ok, err := matchModelPattern(pattern, model); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Text patterns, e.g. for matching system prompts, are plain substrings
+// unless wrapped in slashes like model patterns.
+func matchTextPattern(pattern, text string) (bool, error) {
+	if isRegexpPattern(pattern) {
+		re, err := compileRegexpPattern(pattern)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(text), nil
+	}
+	return strings.Contains(text, pattern), nil
+}
+
+func validateModelPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := matchModelPattern(pattern, ""); err != nil {
+			return fmt.Errorf("invalid model pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// ModelSettings overrides transformer settings for the models it matches.
+// Unset fields fall back to the values under transforms. A transformer whose
+// settings it overrides runs for its models even if the transformer's own
+// models list leaves them out.
+type ModelSettings struct {
+	Models       []string       `yaml:"models"`
+	Temperature  *float64       `yaml:"temperature"`
+	UserPrompt   string         `yaml:"user_prompt"`
+	SystemPrompt string         `yaml:"system_prompt"`
+	Tools        *ToolsSettings `yaml:"tools"`
+}
+
+type ToolsSettings struct {
+	MaxDescriptionLength *int `yaml:"max_description_length"`
+	// Merged over transforms.tools.descriptions.
+	Descriptions map[string]string `yaml:"descriptions"`
+	// Replaces transforms.tools.remove when set.
+	Remove []string `yaml:"remove"`
+}
+
+// settingsFor returns the first model_settings rule matching model.
+func (c Config) settingsFor(model anthropic.Model) (ModelSettings, bool) {
+	for _, rule := range c.ModelSettings {
+		if matchModel(rule.Models, model) {
+			return rule, true
+		}
+	}
+	return ModelSettings{}, false
+}
+
+// transformsFor returns the transformer settings to use for model, with any
+// matching model_settings rule applied on top of the transforms section.
+func (c Config) transformsFor(model anthropic.Model) TransformsConfig {
+	if rule, ok := c.settingsFor(model); ok {
+		return rule.apply(c.Transforms)
+	}
+	return c.Transforms
+}
+
+func (rule ModelSettings) apply(transforms TransformsConfig) TransformsConfig {
+	// The rule already matched the model, so the transformers it overrides
+	// are no longer restricted by their models list.
+	if rule.Temperature != nil {
+		transforms.Temperature.Value = *rule.Temperature
+		transforms.Temperature.Models = nil
+	}
+	if rule.UserPrompt != "" {
+		transforms.UserPrompt.Template = rule.UserPrompt
+		transforms.UserPrompt.Models = nil
+	}
+	if rule.SystemPrompt != "" {
+		transforms.SystemPrompt.File = rule.SystemPrompt
+		transforms.SystemPrompt.Models = nil
+	}
+	if tools := rule.Tools; tools != nil {
+		transforms.Tools.Models = nil
+		if tools.MaxDescriptionLength != nil {
+			transforms.Tools.MaxDescriptionLength = *tools.MaxDescriptionLength
+		}
+		if len(tools.Descriptions) > 0 {
+			descriptions := make(map[string]string, len(transforms.Tools.Descriptions)+len(tools.Descriptions))
+			for name, file := range transforms.Tools.Descriptions {
+				descriptions[name] = file
+			}
+			for name, file := range tools.Descriptions {
+				descriptions[name] = file
+			}
+			transforms.Tools.Descriptions = descriptions
+		}
+		if tools.Remove != nil {
+			transforms.Tools.Remove = tools.Remove
+		}
+	}
+	return transforms
+}
+
+// hasModelRule reports whether anything in the config targets model.
+func (c Config) hasModelRule(model anthropic.Model) bool {
+	if _, ok := c.settingsFor(model); ok {
+		return true
+	}
+	for _, t := range transformers {
+		if c.Transforms.lookup(t.Name()).applies(model) && t.Applies(model, "/v1/messages") {
+			return true
+		}
+	}
+	return false
+}
+
+// Models Claude Code sends its main requests with, checked whenever the
+// config is loaded. Haiku is left out since its background calls are often
+// deliberately passed through unchanged.
+var claudeCodeModels = []anthropic.Model{
+	anthropic.ModelClaudeSonnet4_20250514,
+	anthropic.ModelClaudeOpus4_20250514,
+}
+
+var observedModels sync.Map // anthropic.Model -> struct{}
+
+// warnUnmatchedModels logs a warning for every model Claude Code is known to
+// use or has sent requests for that no transformer or model_settings rule
+// targets, which usually means the config doesn't cover the model yet. It
+// runs when the config is loaded or reloaded.
+func warnUnmatchedModels(config Config) {
+	models := slices.Clone(claudeCodeModels)
+	observedModels.Range(func(key, _ any) bool {
+		if model := key.(anthropic.Model); !slices.Contains(models, model) {
+			models = append(models, model)
+		}
+		return true
+	})
+	slices.Sort(models)
+	for _, model := range models {
+		if !config.hasModelRule(model) {
+			printWarning(context.Background(), "Model %s matches no transform or model_settings rule, its requests pass through unchanged\n", model)
+		}
+	}
+}
+
+// warnUnmatchedModel does the same for a model the first time a request
+// arrives for it, which catches models that are new since the config was
+// loaded.
+func warnUnmatchedModel(ctx context.Context, config Config, model anthropic.Model) {
+	if _, seen := observedModels.LoadOrStore(model, struct{}{}); seen || slices.Contains(claudeCodeModels, model) {
+		return
+	}
+	if !config.hasModelRule(model) {
+		printWarning(ctx, "Model %s matches no transform or model_settings rule, its requests pass through unchanged\n", model)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestHasModelRule(t *testing.T) {
+	temperature := 0.1
+	tests := []struct {
+		name   string
+		config Config
+		model  anthropic.Model
+		want   bool
+	}{
+		{
+			name:  "nothing enabled",
+			model: "claude-3-haiku-20240307",
+		},
+		{
+			name: "empty models list",
+			config: Config{Transforms: TransformsConfig{
+				Temperature: TemperatureConfig{TransformConfig: TransformConfig{Enabled: true}},
+			}},
+			model: "claude-3-haiku-20240307",
+			want:  true,
+		},
+		{
+			name: "glob",
+			config: Config{Transforms: TransformsConfig{
+				Tools: ToolsConfig{TransformConfig: TransformConfig{Enabled: true, Models: []string{"claude-sonnet-4*"}}},
+			}},
+			model: "claude-sonnet-4-20250514",
+			want:  true,
+		},
+		{
+			name: "glob not matching",
+			config: Config{Transforms: TransformsConfig{
+				Tools: ToolsConfig{TransformConfig: TransformConfig{Enabled: true, Models: []string{"claude-sonnet-4*"}}},
+			}},
+			model: "claude-opus-4-20250514",
+		},
+		{
+			name: "regex",
+			config: Config{Transforms: TransformsConfig{
+				SystemPrompt: SystemPromptConfig{TransformConfig: TransformConfig{Enabled: true, Models: []string{"/^claude-(opus|sonnet)-4/"}}},
+			}},
+			model: "claude-opus-4-20250514",
+			want:  true,
+		},
+		{
+			name: "disabled",
+			config: Config{Transforms: TransformsConfig{
+				Temperature: TemperatureConfig{TransformConfig: TransformConfig{Models: []string{"claude-opus-4*"}}},
+			}},
+			model: "claude-opus-4-20250514",
+		},
+		{
+			name: "model_settings",
+			config: Config{ModelSettings: []ModelSettings{
+				{Models: []string{"claude-3-5-haiku*"}, Temperature: &temperature},
+			}},
+			model: "claude-3-5-haiku-20241022",
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.hasModelRule(tt.model); got != tt.want {
+				t.Errorf("hasModelRule(%s) = %v, want %v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
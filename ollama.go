@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/ollama"
+)
+
+// OllamaConfig sends matching /v1/messages requests to a local Ollama
+// server instead of Anthropic.
+type OllamaConfig struct {
+	// Defaults to the Ollama client's default, http://127.0.0.1:11434.
+	ServerURL string `yaml:"server_url"`
+	// Longest an answer may take, streamed or not. 0 means no limit.
+	Timeout time.Duration `yaml:"timeout"`
+	Routes  []OllamaRoute `yaml:"routes"`
+}
+
+// OllamaRoute picks the requests to serve locally. All match fields must
+// match; empty ones match anything.
+type OllamaRoute struct {
+	Models []string `yaml:"models"`
+	// Text pattern (substring or /regex/) the system prompt must match.
+	System string `yaml:"system"`
+	// Ollama model to answer with, e.g. "llama3.2".
+	Model string `yaml:"model"`
+}
+
+func (c OllamaConfig) validate() error {
+	if c.Timeout < 0 {
+		return errors.New("ollama: timeout must not be negative")
+	}
+	for i, route := range c.Routes {
+		if route.Model == "" {
+			return fmt.Errorf("ollama.routes[%d]: model is required", i)
+		}
+		if err := validateModelPatterns(route.Models); err != nil {
+			return fmt.Errorf("ollama.routes[%d]: %w", i, err)
+		}
+		if _, err := matchTextPattern(route.System, ""); err != nil {
+			return fmt.Errorf("ollama.routes[%d]: invalid system pattern %q: %w", i, route.System, err)
+		}
+	}
+	return nil
+}
+
+func (c OllamaConfig) routeFor(params *anthropic.BetaMessageNewParams) (OllamaRoute, bool) {
+	system := systemText(params)
+	for _, route := range c.Routes {
+		if len(route.Models) > 0 && !matchModel(route.Models, params.Model) {
+			continue
+		}
+		if ok, err := matchTextPattern(route.System, system); err == nil && ok {
+			return route, true
+		}
+	}
+	return OllamaRoute{}, false
+}
+
+// ollamaMessages translates the conversation into Ollama chat messages. Each
+// message becomes a single text; tool calls and results are rendered as text
+// and images are left out.
+func ollamaMessages(params *anthropic.BetaMessageNewParams) []llms.MessageContent {
+	var messages []llms.MessageContent
+	if system := systemText(params); system != "" {
+		messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, system))
+	}
+
+	for _, msg := range params.Messages {
+		role := llms.ChatMessageTypeHuman
+		if msg.Role == anthropic.BetaMessageParamRoleAssistant {
+			role = llms.ChatMessageTypeAI
+		}
+
+		var texts []string
+		for _, block := range msg.Content {
+			switch {
+			case block.OfText != nil:
+				texts = append(texts, block.OfText.Text)
+			case block.OfToolUse != nil:
+				input, _ := json.Marshal(block.OfToolUse.Input)
+				texts = append(texts, fmt.Sprintf("[tool call %s: %s]", block.OfToolUse.Name, input))
+			case block.OfToolResult != nil:
+				for _, content := range block.OfToolResult.Content {
+					if content.OfText != nil {
+						texts = append(texts, "[tool result: "+content.OfText.Text+"]")
+					}
+				}
+			}
+		}
+		if len(texts) > 0 {
+			messages = append(messages, llms.TextParts(role, strings.Join(texts, "\n")))
+		}
+	}
+	return messages
+}
+
+func ollamaCallOptions(params *anthropic.BetaMessageNewParams, route OllamaRoute) []llms.CallOption {
+	options := []llms.CallOption{llms.WithModel(route.Model)}
+	if params.MaxTokens > 0 {
+		options = append(options, llms.WithMaxTokens(int(params.MaxTokens)))
+	}
+	if params.Temperature.Valid() {
+		options = append(options, llms.WithTemperature(params.Temperature.Value))
+	}
+	if len(params.StopSequences) > 0 {
+		options = append(options, llms.WithStopWords(params.StopSequences))
+	}
+	return options
+}
+
+// routeToOllama answers the request with a local Ollama model if a route
+// matches it. Streamed requests get the answer as Anthropic SSE events as
+// Ollama produces it. If Ollama fails before anything was sent, the request
+// goes upstream as usual; if it fails mid-stream, the stream ends with an
+// error event.
+func routeToOllama(r *http.Request, params *anthropic.BetaMessageNewParams, w http.ResponseWriter, state *runtimeState) bool {
+	route, ok := state.config.Ollama.routeFor(params)
+	if !ok {
+		return false
+	}
+
+	var clientOptions []ollama.Option
+	if state.config.Ollama.ServerURL != "" {
+		clientOptions = append(clientOptions, ollama.WithServerURL(state.config.Ollama.ServerURL))
+	}
+	client, err := ollama.New(append(clientOptions, ollama.WithModel(route.Model))...)
+	if err != nil {
+		printRed(r.Context(), "Error creating Ollama client, forwarding upstream: %v\n", err)
+		return false
+	}
+
+	printYellow(r.Context(), "Routing %s request to Ollama model %s\n", params.Model, route.Model)
+	options := ollamaCallOptions(params, route)
+
+	stream := isStreaming(params)
+	started := false
+	if stream {
+		options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			if len(chunk) == 0 {
+				return nil
+			}
+			events := []*sseEvent{textDeltaEvent(string(chunk))}
+			if !started {
+				startSyntheticStream(w)
+				events = append(textMessagePrologue(params.Model), events...)
+				started = true
+			}
+			return writeSyntheticEvents(w, events)
+		}))
+	}
+
+	ctx := r.Context()
+	if timeout := state.config.Ollama.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	resp, err := generateOllama(ctx, client, ollamaMessages(params), options)
+	if err != nil {
+		if !started {
+			printRed(r.Context(), "Error from Ollama, forwarding upstream: %v\n", err)
+			return false
+		}
+		// The client already has part of the answer, so end the stream the
+		// way the API does when it fails mid-response.
+		printRed(r.Context(), "Error from Ollama mid-stream: %v\n", err)
+		writeSyntheticEvents(w, []*sseEvent{errorEvent("api_error", "Ollama failed mid-stream: "+err.Error())})
+		return true
+	}
+
+	var text string
+	var u usage
+	if len(resp.Choices) > 0 {
+		choice := resp.Choices[0]
+		text = choice.Content
+		u.InputTokens = ollamaTokenCount(choice.GenerationInfo["PromptTokens"])
+		u.OutputTokens = ollamaTokenCount(choice.GenerationInfo["CompletionTokens"])
+	}
+	printGreen(r.Context(), "Ollama answered with %d output tokens\n", u.OutputTokens)
+
+	switch {
+	case !stream:
+		events := textMessagePrologue(params.Model)
+		events = append(events, textDeltaEvent(text))
+		writeSyntheticResponse(r.Context(), w, append(events, textMessageEpilogue(u)...), false)
+	case !started:
+		// Nothing was streamed, e.g. an empty answer.
+		startSyntheticStream(w)
+		writeSyntheticEvents(w, append(textMessagePrologue(params.Model), textMessageEpilogue(u)...))
+	default:
+		writeSyntheticEvents(w, textMessageEpilogue(u))
+	}
+	return true
+}
+
+// generateOllama calls client.GenerateContent, turning a stream that ends
+// early into an error. langchaingo ignores read errors on the stream, e.g.
+// from the timeout, and then panics on the missing final message.
+func generateOllama(ctx context.Context, client *ollama.LLM, messages []llms.MessageContent, options []llms.CallOption) (resp *llms.ContentResponse, err error) {
+	defer func() {
+		if recover() != nil {
+			resp, err = nil, ctx.Err()
+			if err == nil {
+				err = errors.New("stream from Ollama ended before its final message")
+			}
+		}
+	}()
+	return client.GenerateContent(ctx, messages, options...)
+}
+
+func ollamaTokenCount(v any) int64 {
+	n, _ := v.(int)
+	return int64(n)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"text/template"
+)
+
+// promptSet holds every asset referenced by a Config, read into memory and
+// validated up front so a request never sees a half-edited or broken file.
+type promptSet struct {
+	texts     map[string]string // path -> contents
+	templates map[string]*template.Template
+}
+
+func loadPromptSet(config Config) (*promptSet, error) {
+	ps := &promptSet{
+		texts:     make(map[string]string),
+		templates: make(map[string]*template.Template),
+	}
+
+	// Load the base assets plus whatever each model_settings rule swaps in.
+	variants := []TransformsConfig{config.Transforms}
+	for _, rule := range config.ModelSettings {
+		variants = append(variants, rule.apply(config.Transforms))
+	}
+
+	for _, transforms := range variants {
+		if transforms.SystemPrompt.Enabled {
+			if err := ps.loadText(transforms.SystemPrompt.File); err != nil {
+				return nil, err
+			}
+		}
+		if transforms.Tools.Enabled {
+			for _, path := range transforms.Tools.Descriptions {
+				if err := ps.loadText(path); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if transforms.UserPrompt.Enabled {
+			if err := ps.loadTemplate(transforms.UserPrompt.Template, TemplateData{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, rule := range config.CannedResponses {
+		if rule.Template != "" {
+			if err := ps.loadTemplate(rule.Template, CannedTemplateData{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ps, nil
+}
+
+func (ps *promptSet) loadText(path string) error {
+	if _, ok := ps.texts[path]; ok {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ps.texts[path] = string(content)
+	return nil
+}
+
+// loadTemplate parses the template at path and test-executes it with data,
+// a zero value of what it will be executed with.
+func (ps *promptSet) loadTemplate(path string, data any) error {
+	if _, ok := ps.templates[path]; ok {
+		return nil
+	}
+	if err := ps.loadText(path); err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(path).Parse(ps.texts[path])
+	if err != nil {
+		return fmt.Errorf("parsing template %s: %w", path, err)
+	}
+	// Catch references to unknown fields now rather than on the first request.
+	if err := tmpl.Execute(&bytes.Buffer{}, data); err != nil {
+		return fmt.Errorf("executing template %s: %w", path, err)
+	}
+	ps.templates[path] = tmpl
+	return nil
+}
+
+func (ps *promptSet) text(path string) (string, bool) {
+	text, ok := ps.texts[path]
+	return text, ok
+}
+
+func (ps *promptSet) template(path string) (*template.Template, bool) {
+	tmpl, ok := ps.templates[path]
+	return tmpl, ok
+}
+
+// paths returns the sorted list of asset files in the set.
+func (ps *promptSet) paths() []string {
+	paths := make([]string, 0, len(ps.texts))
+	for path := range ps.texts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
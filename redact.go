@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// RedactConfig adds to the secret detectors that scrub everything the
+// booster logs or captures.
+type RedactConfig struct {
+	// Regular expressions whose matches are redacted. If one has a group
+	// named "secret", only that group is replaced.
+	Patterns []string `yaml:"patterns"`
+	// Headers whose values are redacted, on top of the built-in ones.
+	Headers []string `yaml:"headers"`
+}
+
+func (c RedactConfig) validate() error {
+	for _, pattern := range c.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("redact: invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+type secretDetector struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// Values in captured bodies are JSON strings, so secrets are matched
+// without crossing a quote or an escape sequence. Detectors don't start
+// with \b, which an escaped newline like \nAKIA... would defeat.
+var builtinSecretDetectors = []secretDetector{
+	{"anthropic_key", regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]{20,}`)},
+	{"openai_key", regexp.MustCompile(`sk-(?:proj-)?[A-Za-z0-9_-]{32,}`)},
+	{"aws_access_key", regexp.MustCompile(`(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github_token", regexp.MustCompile(`(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+	{"google_api_key", regexp.MustCompile(`AIza[0-9A-Za-z_-]{35}`)},
+	{"slack_token", regexp.MustCompile(`xox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"stripe_key", regexp.MustCompile(`[rs]k_live_[A-Za-z0-9]{20,}`)},
+	{"jwt", regexp.MustCompile(`eyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	{"private_key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----(?:[^"\\]|\\.)*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{"bearer_token", regexp.MustCompile(`(?i)bearer\s+(?P<secret>[A-Za-z0-9._~+/=-]{16,})`)},
+	// Assignments as found in .env files, shell profiles and configs.
+	{"secret_assignment", regexp.MustCompile(`[A-Z0-9_]*(?:SECRET|TOKEN|PASSWORD|PASSWD|API_KEY|APIKEY|ACCESS_KEY|PRIVATE_KEY|CREDENTIALS?)[A-Z0-9_]*\s*[=:]\s*\\?["']?(?P<secret>[^\s"'\\]{8,})`)},
+}
+
+// Headers that carry credentials.
+var builtinRedactedHeaders = []string{"X-Api-Key", "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+const redactedHeaderValue = "[REDACTED]"
+
+// redactor scrubs secrets from bodies, headers and log lines.
+type redactor struct {
+	detectors []secretDetector
+	headers   []string
+}
+
+var defaultRedactor = &redactor{detectors: builtinSecretDetectors, headers: builtinRedactedHeaders}
+
+// newRedactor combines the built-in detectors with those in c, which has
+// been validated.
+func newRedactor(c RedactConfig) *redactor {
+	rd := &redactor{
+		detectors: slices.Clone(builtinSecretDetectors),
+		headers:   slices.Clone(builtinRedactedHeaders),
+	}
+	for _, pattern := range c.Patterns {
+		rd.detectors = append(rd.detectors, secretDetector{"custom", regexp.MustCompile(pattern)})
+	}
+	for _, name := range c.Headers {
+		rd.headers = append(rd.headers, http.CanonicalHeaderKey(name))
+	}
+	return rd
+}
+
+// currentRedactor returns the redactor of the live configuration.
+func currentRedactor() *redactor {
+	if state := liveState.Load(); state != nil {
+		return state.redactor
+	}
+	return defaultRedactor
+}
+
+// redact returns b with every secret replaced by [REDACTED:<detector>]. b
+// itself is left untouched.
+func (rd *redactor) redact(b []byte) []byte {
+	for _, d := range rd.detectors {
+		b = redactMatches(b, d)
+	}
+	return b
+}
+
+func (rd *redactor) redactString(s string) string {
+	return string(rd.redact([]byte(s)))
+}
+
+func redactMatches(b []byte, d secretDetector) []byte {
+	matches := d.re.FindAllSubmatchIndex(b, -1)
+	if len(matches) == 0 {
+		return b
+	}
+	group := max(d.re.SubexpIndex("secret"), 0)
+	replacement := "[REDACTED:" + d.name + "]"
+
+	var out []byte
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if m[2*group] >= 0 {
+			start, end = m[2*group], m[2*group+1]
+		}
+		out = append(out, b[last:start]...)
+		out = append(out, replacement...)
+		last = end
+	}
+	return append(out, b[last:]...)
+}
+
+// Fields of content_block_delta events that carry streamed content.
+var streamedDeltaFields = []string{"text", "thinking", "partial_json"}
+
+// redactStream redacts a text/event-stream body. The model streams its
+// answer in small deltas, so a secret it echoes back is split over several
+// events where no detector would find it. The deltas of each content block
+// are therefore joined and redacted as one text; a block that had secrets in
+// it is written as a single delta holding the redacted text.
+func (rd *redactor) redactStream(b []byte) []byte {
+	type block struct {
+		events  []*sseEvent
+		payload map[string]any
+		text    strings.Builder
+	}
+	var (
+		events []*sseEvent
+		blocks = make(map[string]*block)
+		order  []string
+	)
+	sr := newSSEReader(bytes.NewReader(b))
+	for {
+		ev, err := sr.next()
+		if err != nil {
+			break
+		}
+		events = append(events, ev)
+		if ev.Event != "content_block_delta" {
+			continue
+		}
+		var payload map[string]any
+		if ev.decode(&payload) != nil {
+			continue
+		}
+		delta, _ := payload["delta"].(map[string]any)
+		for _, field := range streamedDeltaFields {
+			text, ok := delta[field].(string)
+			if !ok {
+				continue
+			}
+			key := fmt.Sprint(payload["index"]) + "." + field
+			blk, ok := blocks[key]
+			if !ok {
+				blk = &block{payload: payload}
+				blocks[key] = blk
+				order = append(order, key)
+			}
+			blk.events = append(blk.events, ev)
+			blk.text.WriteString(text)
+		}
+	}
+
+	changed := false
+	dropped := make(map[*sseEvent]bool)
+	for _, key := range order {
+		blk := blocks[key]
+		text := blk.text.String()
+		redacted := rd.redactString(text)
+		if redacted == text {
+			continue
+		}
+		_, field, _ := strings.Cut(key, ".")
+		blk.payload["delta"].(map[string]any)[field] = redacted
+		if blk.events[0].encode(blk.payload) != nil {
+			continue
+		}
+		changed = true
+		for _, ev := range blk.events[1:] {
+			dropped[ev] = true
+		}
+	}
+	if !changed {
+		return rd.redact(b)
+	}
+
+	var out bytes.Buffer
+	for _, ev := range events {
+		if !dropped[ev] {
+			out.Write(ev.bytes())
+		}
+	}
+	// Secrets outside the deltas, e.g. in message_start, are caught here.
+	return rd.redact(out.Bytes())
+}
+
+// redactHeader returns a copy of header with credential headers masked and
+// secrets in the other values redacted.
+func (rd *redactor) redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for name, values := range header {
+		for i, value := range values {
+			if slices.Contains(rd.headers, name) {
+				values[i] = redactedHeaderValue
+			} else {
+				values[i] = rd.redactString(value)
+			}
+		}
+	}
+	return header
+}
+
+// redactHandler scrubs secrets from log messages and fields before they are
+// written.
+type redactHandler struct {
+	slog.Handler
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	rd := currentRedactor()
+	redacted := slog.NewRecord(r.Time, r.Level, rd.redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(rd.redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	rd := currentRedactor()
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = rd.redactAttr(a)
+	}
+	return &redactHandler{h.Handler.WithAttrs(redacted)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{h.Handler.WithGroup(name)}
+}
+
+func (rd *redactor) redactAttr(a slog.Attr) slog.Attr {
+	switch v := a.Value.Resolve(); v.Kind() {
+	case slog.KindString, slog.KindAny:
+		a.Value = slog.StringValue(rd.redactString(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = rd.redactAttr(ga)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	}
+	return a
+}
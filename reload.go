@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// runtimeState is an immutable snapshot of everything a request needs. It is
+// replaced as a whole on reload so in-flight requests keep a consistent view.
+type runtimeState struct {
+	config   Config
+	target   *url.URL
+	prompts  *promptSet
+	redactor *redactor
+}
+
+var liveState atomic.Pointer[runtimeState]
+
+const watchInterval = 2 * time.Second
+
+// reloader rebuilds the runtime state from the config file and command line
+// overrides whenever either the config or one of its assets changes on disk,
+// or the process receives SIGHUP.
+type reloader struct {
+	configPath string
+	overrides  func(*Config)
+
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newReloader(configPath string, overrides func(*Config)) *reloader {
+	return &reloader{
+		configPath: configPath,
+		overrides:  overrides,
+	}
+}
+
+// load builds and validates a new runtime state without installing it.
+func (rl *reloader) load() (*runtimeState, error) {
+	config, err := loadConfig(rl.configPath)
+	if err != nil {
+		return nil, err
+	}
+	rl.overrides(&config)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	target, err := url.Parse(config.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target URL: %w", err)
+	}
+
+	prompts, err := loadPromptSet(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtimeState{config: config, target: target, prompts: prompts, redactor: newRedactor(config.Redact)}, nil
+}
+
+// init loads the initial state. Unlike reload, a failure here is fatal to the
+// caller since there is no previous version to fall back to.
+func (rl *reloader) init() error {
+	state, err := rl.load()
+	if err != nil {
+		return err
+	}
+	liveState.Store(state)
+	rl.snapshot(state)
+	return nil
+}
+
+func (rl *reloader) reload(reason string) {
+	printYellow(context.Background(), "Reloading configuration (%s)\n", reason)
+
+	state, err := rl.load()
+	if err != nil {
+		printRed(context.Background(), "Reload rejected, keeping previous configuration: %v\n", err)
+		// Still take a new snapshot so we don't retry the same broken file
+		// every tick.
+		rl.snapshot(liveState.Load())
+		return
+	}
+
+	old := liveState.Swap(state)
+	rl.snapshot(state)
+
+	changes := diffRuntimeState(old, state)
+	if len(changes) == 0 {
+		printGreen(context.Background(), "Reload complete, nothing changed\n")
+		return
+	}
+	for _, change := range changes {
+		printGreen(context.Background(), "  %s\n", change)
+	}
+	if old.config.Addr != state.config.Addr || old.config.Port != state.config.Port {
+		printWarning(context.Background(), "Listen address changes only take effect after a restart\n")
+	}
+	setLogLevel(state.config.Log.Level)
+	warnUnmatchedModels(state.config)
+	if old.config.Log.Format != state.config.Log.Format {
+		printWarning(context.Background(), "Log format changes only take effect after a restart\n")
+	}
+}
+
+// watch polls the config file and assets for changes and listens for SIGHUP.
+// It never returns.
+func (rl *reloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			rl.reload("SIGHUP")
+		case <-ticker.C:
+			if changed := rl.changedFiles(); len(changed) > 0 {
+				rl.reload(strings.Join(changed, ", ") + " changed")
+			}
+		}
+	}
+}
+
+func (rl *reloader) watchedFiles(state *runtimeState) []string {
+	files := state.prompts.paths()
+	if rl.configPath != "" {
+		files = append(files, rl.configPath)
+	}
+	return files
+}
+
+func (rl *reloader) snapshot(state *runtimeState) {
+	stamps := make(map[string]fileStamp)
+	for _, path := range rl.watchedFiles(state) {
+		stamps[path] = statFile(path)
+	}
+
+	rl.mu.Lock()
+	rl.stamps = stamps
+	rl.mu.Unlock()
+}
+
+func (rl *reloader) changedFiles() []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var changed []string
+	for path, stamp := range rl.stamps {
+		if statFile(path) != stamp {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// diffRuntimeState describes what changed between two states, one line per
+// config key or asset file.
+func diffRuntimeState(prev, next *runtimeState) []string {
+	var changes []string
+	diffValues("", reflect.ValueOf(prev.config), reflect.ValueOf(next.config), &changes)
+
+	for _, path := range next.prompts.paths() {
+		oldText, ok := prev.prompts.text(path)
+		newText, _ := next.prompts.text(path)
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("asset %s loaded (%d bytes)", path, len(newText)))
+		case oldText != newText:
+			changes = append(changes, fmt.Sprintf("asset %s changed (%d -> %d bytes)", path, len(oldText), len(newText)))
+		}
+	}
+	for _, path := range prev.prompts.paths() {
+		if _, ok := next.prompts.text(path); !ok {
+			changes = append(changes, fmt.Sprintf("asset %s dropped", path))
+		}
+	}
+	return changes
+}
+
+// diffValues walks two config structs in parallel and records leaf values
+// that differ, named by their dotted YAML keys.
+func diffValues(prefix string, prev, next reflect.Value, changes *[]string) {
+	if prev.Kind() == reflect.Struct {
+		for i := 0; i < prev.NumField(); i++ {
+			field := prev.Type().Field(i)
+			name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			key := prefix
+			if opts != "inline" {
+				if name == "" {
+					name = strings.ToLower(field.Name)
+				}
+				key = strings.TrimPrefix(prefix+"."+name, ".")
+			}
+			diffValues(key, prev.Field(i), next.Field(i), changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(prev.Interface(), next.Interface()) {
+		*changes = append(*changes, fmt.Sprintf("%s: %v -> %v", prefix, prev.Interface(), next.Interface()))
+	}
+}
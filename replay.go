@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// replayRequest is a /v1/messages request read back from a JSONL file or a
+// capture directory.
+type replayRequest struct {
+	name string
+	body []byte
+	// Request headers worth sending again, such as anthropic-beta.
+	header http.Header
+	// What happened when the request was captured, if known.
+	baseline *replayResult
+}
+
+// replayResult is what a response boiled down to.
+type replayResult struct {
+	status    int
+	latency   time.Duration
+	firstByte time.Duration
+	usage     usage
+	// Text and tool calls of the response, in order.
+	output string
+}
+
+// Headers carried over from a capture. Credentials are redacted there and
+// come from the replay flags instead.
+var replayHeaders = []string{"Anthropic-Version", "Anthropic-Beta"}
+
+const defaultAnthropicVersion = "2023-06-01"
+
+// runReplay implements the replay subcommand and returns the exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: claude-booster replay [flags] <requests.jsonl | capture dir>...\n\n")
+		fs.PrintDefaults()
+	}
+	target := fs.String("target", "", "Target URL to send the requests to (required)")
+	configPath := fs.String("config", "", "Path to a YAML config file, used with -transform")
+	rootDir := fs.String("root-dir", "", "Root directory for project files, used with -transform")
+	transform := fs.Bool("transform", false, "Run the requests through the current transformers first")
+	apiKey := fs.String("api-key", "", "API key to send as x-api-key (default $ANTHROPIC_API_KEY)")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Timeout per request")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if *apiKey == "" {
+		*apiKey = os.Getenv("ANTHROPIC_API_KEY")
+	}
+
+	var state *runtimeState
+	if *transform {
+		var setFlags []string
+		fs.Visit(func(f *flag.Flag) { setFlags = append(setFlags, f.Name) })
+		overrides := func(config *Config) {
+			config.Target = *target
+			if slices.Contains(setFlags, "root-dir") {
+				config.RootDir = *rootDir
+			}
+		}
+		var err error
+		state, err = newReloader(*configPath, overrides).load()
+		if err != nil {
+			printRed(context.Background(), "Error loading configuration: %v\n", err)
+			return 1
+		}
+		liveState.Store(state)
+		setupLogging(state.config.Log)
+	}
+
+	var requests []replayRequest
+	for _, path := range fs.Args() {
+		loaded, err := loadReplayRequests(path)
+		if err != nil {
+			printRed(context.Background(), "Error reading %s: %v\n", path, err)
+			return 1
+		}
+		requests = append(requests, loaded...)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	var (
+		failed, differ, compared int
+		total, baselineTotal     time.Duration
+		tokens                   usage
+	)
+	for _, req := range requests {
+		result, err := replay(client, req, *target, *apiKey, state)
+		if err != nil {
+			printRed(context.Background(), "%s: %v\n", req.name, err)
+			failed++
+			continue
+		}
+		changed := reportReplay(req, result)
+		if result.status != http.StatusOK {
+			failed++
+			continue
+		}
+		total += result.latency
+		tokens.InputTokens += result.usage.InputTokens
+		tokens.OutputTokens += result.usage.OutputTokens
+		tokens.CacheCreationInputTokens += result.usage.CacheCreationInputTokens
+		tokens.CacheReadInputTokens += result.usage.CacheReadInputTokens
+
+		if req.baseline != nil {
+			compared++
+			baselineTotal += req.baseline.latency
+			if changed {
+				differ++
+			}
+		}
+	}
+
+	replayed := len(requests) - failed
+	printBlue(context.Background(), "Replayed %d of %d requests, %d failed\n", replayed, len(requests), failed)
+	if replayed > 0 {
+		printBlue(context.Background(), "  mean latency %dms, tokens in=%d out=%d cache_write=%d cache_read=%d\n",
+			(total / time.Duration(replayed)).Milliseconds(),
+			tokens.InputTokens, tokens.OutputTokens, tokens.CacheCreationInputTokens, tokens.CacheReadInputTokens)
+	}
+	if compared > 0 {
+		printBlue(context.Background(), "  %d of %d outputs differ from the capture, captured mean latency %dms\n",
+			differ, compared, (baselineTotal / time.Duration(compared)).Milliseconds())
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadReplayRequests reads the requests in path: a JSONL file with one
+// request body per line, a single capture directory or a directory of
+// captures.
+func loadReplayRequests(path string) ([]replayRequest, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return loadReplayJSONL(path)
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "request.json")); err == nil {
+		req, err := loadReplayCapture(path)
+		if err != nil {
+			return nil, err
+		}
+		return []replayRequest{req}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var requests []replayRequest
+	for _, name := range names {
+		dir := filepath.Join(path, name)
+		if _, err := os.Stat(filepath.Join(dir, "request.json")); err != nil {
+			continue
+		}
+		req, err := loadReplayCapture(dir)
+		if errors.Is(err, errNotMessagesCapture) {
+			continue
+		}
+		if errors.Is(err, errTruncatedCapture) {
+			printWarning(context.Background(), "Skipping %s: %v\n", dir, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+func loadReplayJSONL(path string) ([]replayRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []replayRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		body := bytes.TrimSpace(scanner.Bytes())
+		if len(body) == 0 {
+			continue
+		}
+		requests = append(requests, replayRequest{
+			name: fmt.Sprintf("%s:%d", path, line),
+			body: bytes.Clone(body),
+		})
+	}
+	return requests, scanner.Err()
+}
+
+var (
+	errNotMessagesCapture = errors.New("not a /v1/messages capture")
+	// A request cut off at capture.max_body_bytes isn't valid JSON.
+	errTruncatedCapture = errors.New("truncated request, raise capture.max_body_bytes to replay it")
+)
+
+func loadReplayCapture(dir string) (replayRequest, error) {
+	req := replayRequest{name: dir, header: make(http.Header)}
+
+	var meta captureMeta
+	metaBytes, err := os.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return req, err
+	}
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return req, fmt.Errorf("parsing meta.json: %w", err)
+	}
+	if meta.Path != "/v1/messages" {
+		return req, errNotMessagesCapture
+	}
+	if slices.Contains(meta.Truncated, "request.json") {
+		return req, errTruncatedCapture
+	}
+	for _, name := range replayHeaders {
+		if v := meta.RequestHeader.Get(name); v != "" {
+			req.header.Set(name, v)
+		}
+	}
+
+	if req.body, err = os.ReadFile(filepath.Join(dir, "request.json")); err != nil {
+		return req, err
+	}
+
+	for _, name := range []string{"response.sse", "response.json"} {
+		body, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		baseline := &replayResult{
+			status:    meta.Status,
+			latency:   time.Duration(meta.DurationMS) * time.Millisecond,
+			firstByte: time.Duration(meta.FirstByteMS) * time.Millisecond,
+		}
+		// A truncated response can't be compared against.
+		if parseReplayResponse(body, name == "response.sse", baseline) == nil && !slices.Contains(meta.Truncated, name) {
+			req.baseline = baseline
+		}
+		break
+	}
+	return req, nil
+}
+
+// replay sends req to target, after running it through the transformers if
+// state is set.
+func replay(client *http.Client, req replayRequest, target, apiKey string, state *runtimeState) (*replayResult, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(target, "/")+"/v1/messages", nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header = req.header.Clone()
+	if httpReq.Header == nil {
+		httpReq.Header = make(http.Header)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if httpReq.Header.Get("Anthropic-Version") == "" {
+		httpReq.Header.Set("Anthropic-Version", defaultAnthropicVersion)
+	}
+	if apiKey != "" {
+		httpReq.Header.Set("X-Api-Key", apiKey)
+	} else if token := os.Getenv("ANTHROPIC_AUTH_TOKEN"); token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	params, err := parseMessageParams(req.body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing request: %w", err)
+	}
+	info := newRequestInfo(httpReq)
+	info.model = params.Model
+	httpReq = httpReq.WithContext(addRequestInfoToContext(context.Background(), info))
+
+	body := req.body
+	if state != nil {
+		original, _ := parseMessageParams(req.body)
+		modelRewritten := rewriteModel(httpReq, &params, state.config)
+		bodyModified := runTransformers(&transformContext{
+			params:  &params,
+			state:   state,
+			request: httpReq,
+		})
+		if bodyModified || modelRewritten {
+			if body, err = json.Marshal(params); err != nil {
+				return nil, fmt.Errorf("marshaling transformed request: %w", err)
+			}
+			if state.config.Diff {
+				logRequestDiff(httpReq.Context(), diffRequests(&original, &params))
+			}
+		}
+	}
+	httpReq.Body = io.NopCloser(bytes.NewReader(body))
+	httpReq.ContentLength = int64(len(body))
+
+	start := time.Now()
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &replayResult{status: resp.StatusCode, firstByte: time.Since(start)}
+	respBody, err := io.ReadAll(resp.Body)
+	result.latency = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		result.output = string(respBody)
+		return result, nil
+	}
+	stream := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	if err := parseReplayResponse(respBody, stream, result); err != nil {
+		return nil, fmt.Errorf("parsing response: %w", err)
+	}
+	return result, nil
+}
+
+// parseReplayResponse fills in the usage and output of result from a
+// response body.
+func parseReplayResponse(body []byte, stream bool, result *replayResult) error {
+	if stream {
+		var events []*sseEvent
+		sr := newSSEReader(bytes.NewReader(body))
+		for {
+			ev, err := sr.next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			events = append(events, ev)
+		}
+		folded, err := foldMessageEvents(events)
+		if err != nil {
+			return err
+		}
+		body = folded
+	}
+
+	var message struct {
+		Content []struct {
+			Type  string          `json:"type"`
+			Text  string          `json:"text"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+		Usage usage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		return err
+	}
+
+	var output []string
+	for _, block := range message.Content {
+		switch block.Type {
+		case "text":
+			output = append(output, block.Text)
+		case "tool_use":
+			output = append(output, fmt.Sprintf("[tool_use %s %s]", block.Name, block.Input))
+		}
+	}
+	result.usage = message.Usage
+	result.output = strings.Join(output, "\n")
+	return nil
+}
+
+// reportReplay logs the outcome of a replayed request next to its captured
+// counterpart and reports whether the output changed.
+func reportReplay(req replayRequest, result *replayResult) bool {
+	attrs := []slog.Attr{
+		slog.Int("status", result.status),
+		slog.Int64("latency_ms", result.latency.Milliseconds()),
+		slog.Int64("first_byte_ms", result.firstByte.Milliseconds()),
+		slog.Int64("input_tokens", result.usage.InputTokens),
+		slog.Int64("output_tokens", result.usage.OutputTokens),
+		slog.Int64("cache_write_tokens", result.usage.CacheCreationInputTokens),
+		slog.Int64("cache_read_tokens", result.usage.CacheReadInputTokens),
+	}
+	if result.status != http.StatusOK {
+		logAttrs(context.Background(), slog.LevelError, colorRed, req.name+": "+shortenDiffValue(result.output), attrs...)
+		return false
+	}
+
+	baseline := req.baseline
+	if baseline == nil {
+		logAttrs(context.Background(), slog.LevelInfo, colorGreen, req.name, attrs...)
+		return false
+	}
+
+	change := requestChange{Field: "output", Kind: changeModified, Before: baseline.output, After: result.output}
+	changed := baseline.output != result.output
+	outcome := "identical"
+	if changed {
+		outcome = "differs"
+	}
+	attrs = append(attrs,
+		slog.Int64("captured_latency_ms", baseline.latency.Milliseconds()),
+		slog.Int64("captured_input_tokens", baseline.usage.InputTokens),
+		slog.Int64("captured_output_tokens", baseline.usage.OutputTokens),
+		slog.String("output", outcome))
+	logAttrs(context.Background(), slog.LevelInfo, colorGreen, req.name, attrs...)
+	if changed {
+		printYellow(context.Background(), "  output %s\n", change.summary())
+	}
+	return changed
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const replayBody = `{"model":"claude-sonnet-4-20250514","max_tokens":1024,"messages":[{"role":"user","content":"hi"}]}`
+
+// streamedText returns the SSE stream of a reply holding text, cut into
+// deltas of a few bytes each the way the API streams it.
+func streamedText(text string) []byte {
+	events := textMessagePrologue("claude-sonnet-4-20250514")
+	for len(text) > 0 {
+		n := min(len(text), 5)
+		events = append(events, textDeltaEvent(text[:n]))
+		text = text[n:]
+	}
+	var out bytes.Buffer
+	for _, ev := range append(events, textMessageEpilogue(usage{})...) {
+		out.Write(ev.bytes())
+	}
+	return out.Bytes()
+}
+
+// writeTestCapture lays out a capture directory the way finishCapture does.
+func writeTestCapture(t *testing.T, dir string, meta captureMeta, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["meta.json"] = string(metaBytes)
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadReplayJSONL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	os.WriteFile(path, []byte(replayBody+"\n\n  "+replayBody+"  \n"), 0o600)
+
+	requests, err := loadReplayRequests(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("loaded %d requests, want 2", len(requests))
+	}
+	for _, req := range requests {
+		if string(req.body) != replayBody || req.baseline != nil {
+			t.Errorf("unexpected request %s: %s", req.name, req.body)
+		}
+	}
+	if want := path + ":3"; requests[1].name != want {
+		t.Errorf("second request named %s, want %s", requests[1].name, want)
+	}
+}
+
+func TestLoadReplayCapture(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "20250601-120000.000-0a1b2c3d")
+	header := http.Header{}
+	header.Set("Anthropic-Beta", "prompt-caching-2024-07-31")
+	header.Set("X-Api-Key", redactedHeaderValue)
+	writeTestCapture(t, dir, captureMeta{
+		Path:          "/v1/messages",
+		Status:        http.StatusOK,
+		DurationMS:    1500,
+		RequestHeader: header,
+	}, map[string]string{
+		"request.json":  replayBody,
+		"response.json": `{"content":[{"type":"text","text":"Hello"}],"usage":{"input_tokens":10,"output_tokens":2}}`,
+	})
+
+	requests, err := loadReplayRequests(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("loaded %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if string(req.body) != replayBody {
+		t.Errorf("body = %s", req.body)
+	}
+	if got := req.header.Get("Anthropic-Beta"); got != "prompt-caching-2024-07-31" {
+		t.Errorf("Anthropic-Beta = %q", got)
+	}
+	if got := req.header.Get("X-Api-Key"); got != "" {
+		t.Errorf("X-Api-Key carried over from the capture: %q", got)
+	}
+	if req.baseline == nil {
+		t.Fatal("no baseline")
+	}
+	if req.baseline.output != "Hello" || req.baseline.usage.OutputTokens != 2 || req.baseline.latency.Milliseconds() != 1500 {
+		t.Errorf("unexpected baseline: %+v", req.baseline)
+	}
+}
+
+func TestLoadReplayCaptureDir(t *testing.T) {
+	root := t.TempDir()
+	writeTestCapture(t, filepath.Join(root, "20250601-120002.000-cccccccc"),
+		captureMeta{Path: "/v1/messages"}, map[string]string{"request.json": replayBody})
+	writeTestCapture(t, filepath.Join(root, "20250601-120000.000-aaaaaaaa"),
+		captureMeta{Path: "/v1/messages"}, map[string]string{"request.json": replayBody})
+	// Skipped: not a messages request, a truncated request and no request.
+	writeTestCapture(t, filepath.Join(root, "20250601-120001.000-bbbbbbbb"),
+		captureMeta{Path: "/v1/messages/count_tokens"}, map[string]string{"request.json": replayBody})
+	writeTestCapture(t, filepath.Join(root, "20250601-120003.000-dddddddd"),
+		captureMeta{Path: "/v1/messages", Truncated: []string{"request.json"}}, map[string]string{"request.json": replayBody[:20]})
+	os.Mkdir(filepath.Join(root, "notes"), 0o700)
+
+	requests, err := loadReplayRequests(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, req := range requests {
+		names = append(names, filepath.Base(req.name))
+	}
+	want := []string{"20250601-120000.000-aaaaaaaa", "20250601-120002.000-cccccccc"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		t.Errorf("loaded %v, want %v", names, want)
+	}
+}
+
+func TestLoadReplayCaptureTruncated(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCapture(t, dir, captureMeta{Path: "/v1/messages", Truncated: []string{"request.json"}},
+		map[string]string{"request.json": replayBody[:20]})
+	if _, err := loadReplayRequests(dir); !errors.Is(err, errTruncatedCapture) {
+		t.Errorf("loading a truncated request: %v, want %v", err, errTruncatedCapture)
+	}
+
+	// A truncated response only loses the baseline.
+	writeTestCapture(t, dir, captureMeta{Path: "/v1/messages", Truncated: []string{"response.sse"}},
+		map[string]string{"request.json": replayBody, "response.sse": string(streamedText("Hello"))})
+	requests, err := loadReplayRequests(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests[0].baseline != nil {
+		t.Errorf("baseline from a truncated response: %+v", requests[0].baseline)
+	}
+}
+
+func TestParseReplayResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		stream bool
+		want   string
+	}{
+		{
+			name:   "stream",
+			body:   string(streamedText("Hello there, how can I help?")),
+			stream: true,
+			want:   "Hello there, how can I help?",
+		},
+		{
+			name: "message",
+			body: `{"content":[
+				{"type":"text","text":"Let me look."},
+				{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"main.go"}}
+			],"usage":{"input_tokens":10,"output_tokens":20,"cache_read_input_tokens":300}}`,
+			want: `Let me look.` + "\n" + `[tool_use Read {"file_path":"main.go"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result replayResult
+			if err := parseReplayResponse([]byte(tt.body), tt.stream, &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.output != tt.want {
+				t.Errorf("output = %q, want %q", result.output, tt.want)
+			}
+		})
+	}
+
+	var result replayResult
+	parseReplayResponse([]byte(`{"content":[],"usage":{"input_tokens":10,"output_tokens":20,"cache_read_input_tokens":300}}`), false, &result)
+	if result.usage.InputTokens != 10 || result.usage.OutputTokens != 20 || result.usage.CacheReadInputTokens != 300 {
+		t.Errorf("usage = %+v", result.usage)
+	}
+
+	if err := parseReplayResponse([]byte(`{"content":[`), false, &result); err == nil {
+		t.Error("no error for a cut off response")
+	}
+}
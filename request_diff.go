@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Kinds of requestChange.
+const (
+	changeModified = "modified"
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+)
+
+// requestChange is one difference between the request the client sent and
+// the one the booster forwarded.
+type requestChange struct {
+	// What changed, e.g. "temperature", "system[1]" or
+	// "tools.Bash.description".
+	Field  string `json:"field"`
+	Kind   string `json:"kind"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Values up to this long are shown in full on the console.
+const shortDiffValue = 80
+
+// summary renders the change for a single console line.
+func (c requestChange) summary() string {
+	switch c.Kind {
+	case changeAdded:
+		return "added " + shortenDiffValue(c.After)
+	case changeRemoved:
+		return "removed " + shortenDiffValue(c.Before)
+	}
+	if c.Field == "cache_control" {
+		// At most four breakpoints on either side, so show them all.
+		return c.Before + " → " + c.After
+	}
+	if len(c.Before) <= shortDiffValue && len(c.After) <= shortDiffValue &&
+		!strings.Contains(c.Before, "\n") && !strings.Contains(c.After, "\n") {
+		return fmt.Sprintf("%q → %q", c.Before, c.After)
+	}
+
+	before, after := strings.Split(c.Before, "\n"), strings.Split(c.After, "\n")
+	line := 0
+	for line < len(before) && line < len(after) && before[line] == after[line] {
+		line++
+	}
+	var first []string
+	if line < len(before) {
+		first = append(first, "-"+strconv.Quote(shortenDiffValue(before[line])))
+	}
+	if line < len(after) {
+		first = append(first, "+"+strconv.Quote(shortenDiffValue(after[line])))
+	}
+	return fmt.Sprintf("%d → %d chars, first change on line %d: %s",
+		len(c.Before), len(c.After), line+1, strings.Join(first, " "))
+}
+
+func shortenDiffValue(s string) string {
+	if len(s) <= shortDiffValue {
+		return s
+	}
+	n := shortDiffValue
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "…"
+}
+
+// diffRequests compares the parts of a request the transformers touch:
+// model, temperature, system blocks, tools and their descriptions, cache
+// breakpoints and the first user message.
+func diffRequests(original, modified *anthropic.BetaMessageNewParams) []requestChange {
+	var changes []requestChange
+	compare := func(field, before, after string, hadBefore, hasAfter bool) {
+		switch {
+		case hadBefore && !hasAfter:
+			changes = append(changes, requestChange{Field: field, Kind: changeRemoved, Before: before})
+		case !hadBefore && hasAfter:
+			changes = append(changes, requestChange{Field: field, Kind: changeAdded, After: after})
+		case hadBefore && before != after:
+			changes = append(changes, requestChange{Field: field, Kind: changeModified, Before: before, After: after})
+		}
+	}
+
+	compare("model", string(original.Model), string(modified.Model), true, true)
+
+	temperature := func(params *anthropic.BetaMessageNewParams) string {
+		return strconv.FormatFloat(params.Temperature.Value, 'g', -1, 64)
+	}
+	compare("temperature", temperature(original), temperature(modified),
+		original.Temperature.Valid(), modified.Temperature.Valid())
+
+	for i := 0; i < max(len(original.System), len(modified.System)); i++ {
+		var before, after string
+		if i < len(original.System) {
+			before = original.System[i].Text
+		}
+		if i < len(modified.System) {
+			after = modified.System[i].Text
+		}
+		compare(fmt.Sprintf("system[%d]", i), before, after, i < len(original.System), i < len(modified.System))
+	}
+
+	originalTools := toolDescriptions(original)
+	modifiedTools := toolDescriptions(modified)
+	for _, tool := range original.Tools {
+		name := *tool.GetName()
+		if _, ok := modifiedTools[name]; !ok {
+			changes = append(changes, requestChange{Field: "tools." + name, Kind: changeRemoved, Before: originalTools[name]})
+			continue
+		}
+		compare("tools."+name+".description", originalTools[name], modifiedTools[name], true, true)
+	}
+	for _, tool := range modified.Tools {
+		name := *tool.GetName()
+		if _, ok := originalTools[name]; !ok {
+			changes = append(changes, requestChange{Field: "tools." + name, Kind: changeAdded, After: modifiedTools[name]})
+		}
+	}
+
+	before := strings.Join(cacheBreakpointPlacements(original), ", ")
+	after := strings.Join(cacheBreakpointPlacements(modified), ", ")
+	compare("cache_control", before, after, before != "", after != "")
+
+	compare("messages[0]", firstUserText(original), firstUserText(modified), true, true)
+	return changes
+}
+
+// toolDescriptions maps tool names to their descriptions. Server tools have
+// an empty description.
+func toolDescriptions(params *anthropic.BetaMessageNewParams) map[string]string {
+	descriptions := make(map[string]string, len(params.Tools))
+	for _, tool := range params.Tools {
+		var desc string
+		if d := tool.GetDescription(); d != nil {
+			desc = *d
+		}
+		descriptions[*tool.GetName()] = desc
+	}
+	return descriptions
+}
+
+// cacheBreakpointPlacements lists where the request has cache breakpoints
+// and with which TTL, e.g. "tools.Read 5m".
+func cacheBreakpointPlacements(params *anthropic.BetaMessageNewParams) []string {
+	var placements []string
+	for _, tool := range params.Tools {
+		if cc := tool.GetCacheControl(); isCacheBreakpoint(cc) {
+			placements = append(placements, fmt.Sprintf("tools.%s %s", *tool.GetName(), ttlName(cc.TTL)))
+		}
+	}
+	for i := range params.System {
+		if cc := &params.System[i].CacheControl; isCacheBreakpoint(cc) {
+			placements = append(placements, fmt.Sprintf("system[%d] %s", i, ttlName(cc.TTL)))
+		}
+	}
+	for i, msg := range params.Messages {
+		for j, block := range msg.Content {
+			if cc := block.GetCacheControl(); isCacheBreakpoint(cc) {
+				placements = append(placements, fmt.Sprintf("messages[%d].content[%d] %s", i, j, ttlName(cc.TTL)))
+			}
+		}
+	}
+	return placements
+}
+
+// firstUserText returns the text of the first message if it is a user
+// message, which is where Claude Code puts its context reminder.
+func firstUserText(params *anthropic.BetaMessageNewParams) string {
+	if len(params.Messages) == 0 || params.Messages[0].Role != anthropic.BetaMessageParamRoleUser {
+		return ""
+	}
+	var texts []string
+	for _, block := range params.Messages[0].Content {
+		if text := block.GetText(); text != nil {
+			texts = append(texts, *text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// logRequestDiff prints one line per change.
+func logRequestDiff(ctx context.Context, changes []requestChange) {
+	for _, c := range changes {
+		logAttrs(ctx, slog.LevelInfo, colorBlue, "diff "+c.Field+": "+c.summary(),
+			slog.String("field", c.Field), slog.String("kind", c.Kind))
+	}
+}
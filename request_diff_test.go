@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// diffBase is the request the client sends in the diff tests. Each case
+// edits a copy of it.
+const diffBase = `{
+	"model": "claude-sonnet-4-20250514",
+	"max_tokens": 32000,
+	"system": [{"type": "text", "text": "You are Claude Code."}],
+	"tools": [
+		{"name": "Bash", "description": "Runs a command.", "input_schema": {"type": "object"}},
+		{"name": "NotebookRead", "description": "Reads a notebook.", "input_schema": {"type": "object"}}
+	],
+	"messages": [{"role": "user", "content": [
+		{"type": "text", "text": "<system-reminder>context</system-reminder>", "cache_control": {"type": "ephemeral"}}
+	]}]
+}`
+
+func TestDiffRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		modified string
+		want     []requestChange
+	}{
+		{
+			name:     "unchanged",
+			original: diffBase,
+			modified: diffBase,
+		},
+		{
+			name:     "temperature added",
+			original: diffBase,
+			modified: strings.Replace(diffBase, `"max_tokens": 32000,`, `"max_tokens": 32000, "temperature": 0.1,`, 1),
+			want:     []requestChange{{Field: "temperature", Kind: changeAdded, After: "0.1"}},
+		},
+		{
+			name:     "temperature modified",
+			original: strings.Replace(diffBase, `"max_tokens": 32000,`, `"max_tokens": 32000, "temperature": 1,`, 1),
+			modified: strings.Replace(diffBase, `"max_tokens": 32000,`, `"max_tokens": 32000, "temperature": 0.1,`, 1),
+			want:     []requestChange{{Field: "temperature", Kind: changeModified, Before: "1", After: "0.1"}},
+		},
+		{
+			name:     "model rewritten",
+			original: diffBase,
+			modified: strings.Replace(diffBase, "claude-sonnet-4-20250514", "claude-opus-4-20250514", 1),
+			want:     []requestChange{{Field: "model", Kind: changeModified, Before: "claude-sonnet-4-20250514", After: "claude-opus-4-20250514"}},
+		},
+		{
+			name:     "system block replaced and added",
+			original: diffBase,
+			modified: strings.Replace(diffBase,
+				`"system": [{"type": "text", "text": "You are Claude Code."}]`,
+				`"system": [{"type": "text", "text": "You are Claude."}, {"type": "text", "text": "Be brief."}]`, 1),
+			want: []requestChange{
+				{Field: "system[0]", Kind: changeModified, Before: "You are Claude Code.", After: "You are Claude."},
+				{Field: "system[1]", Kind: changeAdded, After: "Be brief."},
+			},
+		},
+		{
+			name:     "tool description replaced",
+			original: diffBase,
+			modified: strings.Replace(diffBase, "Runs a command.", "Runs a shell command.", 1),
+			want:     []requestChange{{Field: "tools.Bash.description", Kind: changeModified, Before: "Runs a command.", After: "Runs a shell command."}},
+		},
+		{
+			name:     "tool removed",
+			original: diffBase,
+			modified: strings.Replace(diffBase,
+				`,
+		{"name": "NotebookRead", "description": "Reads a notebook.", "input_schema": {"type": "object"}}`, "", 1),
+			want: []requestChange{{Field: "tools.NotebookRead", Kind: changeRemoved, Before: "Reads a notebook."}},
+		},
+		{
+			name:     "cache breakpoints moved",
+			original: diffBase,
+			modified: strings.NewReplacer(
+				`"text": "You are Claude Code."}`, `"text": "You are Claude Code.", "cache_control": {"type": "ephemeral", "ttl": "1h"}}`,
+				`, "cache_control": {"type": "ephemeral"}}`, `}`,
+			).Replace(diffBase),
+			want: []requestChange{{Field: "cache_control", Kind: changeModified, Before: "messages[0].content[0] 5m", After: "system[0] 1h"}},
+		},
+		{
+			name:     "first user message rewritten",
+			original: diffBase,
+			modified: strings.Replace(diffBase, "<system-reminder>context</system-reminder>", "Project instructions", 1),
+			want: []requestChange{{Field: "messages[0]", Kind: changeModified,
+				Before: "<system-reminder>context</system-reminder>", After: "Project instructions"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original, err := parseMessageParams([]byte(tt.original))
+			if err != nil {
+				t.Fatal(err)
+			}
+			modified, err := parseMessageParams([]byte(tt.modified))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := diffRequests(&original, &modified); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffRequests() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestChangeSummary(t *testing.T) {
+	long := strings.Repeat("Use the Read tool to read files.\n", 5)
+	tests := []struct {
+		change requestChange
+		want   string
+	}{
+		{requestChange{Field: "temperature", Kind: changeModified, Before: "1", After: "0.1"}, `"1" → "0.1"`},
+		{requestChange{Field: "temperature", Kind: changeAdded, After: "0.1"}, "added 0.1"},
+		{requestChange{Field: "tools.NotebookRead", Kind: changeRemoved, Before: "Reads a notebook."}, "removed Reads a notebook."},
+		{requestChange{Field: "cache_control", Kind: changeModified, Before: "system[0] 5m", After: "system[0] 1h, tools.Bash 1h"},
+			"system[0] 5m → system[0] 1h, tools.Bash 1h"},
+		{requestChange{Field: "system[1]", Kind: changeModified, Before: long, After: strings.Replace(long, "\nUse the Read", "\nUse Read", 1)},
+			`165 → 161 chars, first change on line 2: -"Use the Read tool to read files." +"Use Read tool to read files."`},
+		{requestChange{Field: "system[1]", Kind: changeModified, Before: strings.Repeat("é", 100), After: "x"},
+			"200 → 1 chars, first change on line 1: -\"" + strings.Repeat("é", 40) + "…\" +\"x\""},
+	}
+	for _, tt := range tests {
+		if got := tt.change.summary(); got != tt.want {
+			t.Errorf("summary of %s = %s, want %s", tt.change.Field, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResponseTransformer observes or rewrites the upstream response to a
+// /v1/messages request. Register new ones with registerResponseTransformer
+// from an init function.
+//
+// Streamed responses are handed over one event at a time as they arrive.
+// Non-streaming responses are presented as a single event named "message"
+// whose data is the whole JSON body.
+type ResponseTransformer interface {
+	// Name identifies the transformer in logs.
+	Name() string
+	// Order positions the transformer in the pipeline. Lower runs first.
+	Order() int
+	// Applies reports whether the transformer wants to see this response.
+	Applies(rc *responseContext) bool
+	// TransformEvent may modify ev in place. Returning false drops the
+	// event from the stream.
+	TransformEvent(rc *responseContext, ev *sseEvent) bool
+}
+
+// responseContext is what a ResponseTransformer gets to work with for one
+// response.
+type responseContext struct {
+	// The request as sent upstream; its context carries everything the
+	// request side stored for the response side.
+	request  *http.Request
+	response *http.Response
+}
+
+var responseTransformers []ResponseTransformer
+
+func registerResponseTransformer(t ResponseTransformer) {
+	responseTransformers = append(responseTransformers, t)
+	sort.SliceStable(responseTransformers, func(i, j int) bool {
+		return responseTransformers[i].Order() < responseTransformers[j].Order()
+	})
+}
+
+// interceptResponse installs the response transformers that apply to resp,
+// or stands in for a failed count_tokens call. It is used as the reverse
+// proxy's ModifyResponse hook.
+func interceptResponse(resp *http.Response) error {
+	if resp.Request.URL.Path == "/v1/messages/count_tokens" {
+		return answerTokenCountLocally(resp)
+	}
+	if resp.Request.URL.Path != "/v1/messages" || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	rc := &responseContext{request: resp.Request, response: resp}
+	var active []ResponseTransformer
+	for _, t := range responseTransformers {
+		if t.Applies(rc) {
+			active = append(active, t)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	if ok, err := decodeResponseBody(resp); !ok || err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body = newSSETransformBody(resp.Body, rc, active)
+		return nil
+	}
+
+	// Non-streaming: transform the whole body as one event.
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	ev := &sseEvent{Event: "message", Data: body}
+	applyResponseTransformers(rc, active, ev)
+	resp.Body = io.NopCloser(bytes.NewReader(ev.Data))
+	resp.ContentLength = int64(len(ev.Data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(ev.Data)))
+	return nil
+}
+
+// decodeResponseBody undoes the Content-Encoding of resp so the body can be
+// parsed, and reports whether it can be. The client gets the decoded body.
+func decodeResponseBody(resp *http.Response) (bool, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return true, nil
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return false, fmt.Errorf("decoding gzip response: %w", err)
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{zr, resp.Body}
+	default:
+		// Other encodings, e.g. br, go to the client untouched.
+		printDebug(resp.Request.Context(), "Not transforming response with Content-Encoding %s\n", encoding)
+		return false, nil
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return true, nil
+}
+
+func applyResponseTransformers(rc *responseContext, active []ResponseTransformer, ev *sseEvent) bool {
+	for _, t := range active {
+		if !t.TransformEvent(rc, ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// newSSETransformBody returns a body that parses the upstream stream, runs
+// each event through the transformers and re-emits it. Every event is written
+// to the pipe with a single Write, and the reverse proxy flushes event
+// streams after each write, so events still reach the client as they arrive.
+func newSSETransformBody(upstream io.ReadCloser, rc *responseContext, active []ResponseTransformer) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer upstream.Close()
+
+		reader := newSSEReader(upstream)
+		for {
+			ev, err := reader.next()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+
+			if !applyResponseTransformers(rc, active, ev) {
+				continue
+			}
+			if err := writeSSEEvent(pw, ev); err != nil {
+				// The client went away.
+				return
+			}
+		}
+	}()
+
+	return pr
+}
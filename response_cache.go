@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// ResponseCacheConfig enables replaying earlier responses to identical
+// /v1/messages requests. Only requests with temperature 0 that match one of
+// the rules are cached, since anything else isn't meant to be repeatable.
+type ResponseCacheConfig struct {
+	Enabled    bool                `yaml:"enabled"`
+	TTL        time.Duration       `yaml:"ttl"`
+	MaxEntries int                 `yaml:"max_entries"`
+	Rules      []ResponseCacheRule `yaml:"rules"`
+}
+
+type ResponseCacheRule struct {
+	// Model patterns the rule applies to. Empty means any model.
+	Models []string `yaml:"models"`
+	// Text pattern the system prompt must match. Empty means any.
+	System string `yaml:"system"`
+}
+
+func (c ResponseCacheConfig) validate() error {
+	if c.TTL < 0 || c.MaxEntries < 0 {
+		return errors.New("response_cache: ttl and max_entries must not be negative")
+	}
+	for _, rule := range c.Rules {
+		if err := validateModelPatterns(rule.Models); err != nil {
+			return fmt.Errorf("response_cache: %w", err)
+		}
+		if _, err := matchTextPattern(rule.System, ""); err != nil {
+			return fmt.Errorf("response_cache: invalid system pattern %q: %w", rule.System, err)
+		}
+	}
+	return nil
+}
+
+// cacheable reports whether responses to params may be cached.
+func (c ResponseCacheConfig) cacheable(params *anthropic.BetaMessageNewParams) bool {
+	if !c.Enabled || !params.Temperature.Valid() || params.Temperature.Value != 0 {
+		return false
+	}
+	system := systemText(params)
+	for _, rule := range c.Rules {
+		if len(rule.Models) > 0 && !matchModel(rule.Models, params.Model) {
+			continue
+		}
+		if ok, err := matchTextPattern(rule.System, system); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func systemText(params *anthropic.BetaMessageNewParams) string {
+	texts := make([]string, len(params.System))
+	for i, block := range params.System {
+		texts[i] = block.Text
+	}
+	return strings.Join(texts, "\n")
+}
+
+// responseCacheFields are the request fields that determine the response.
+var responseCacheFields = []string{
+	"model",
+	"system",
+	"messages",
+	"tools",
+	"tool_choice",
+	"thinking",
+	"mcp_servers",
+	"temperature",
+	"top_k",
+	"top_p",
+	"max_tokens",
+	"stop_sequences",
+	"stream",
+}
+
+// responseCache holds complete responses as the events they were made of,
+// least recently used first out.
+type responseCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+}
+
+type responseCacheEntry struct {
+	key     string
+	events  []*sseEvent
+	expires time.Time // zero if the entry never expires
+}
+
+var globalResponseCache = &responseCache{
+	entries: make(map[string]*list.Element),
+	lru:     list.New(),
+}
+
+func (rc *responseCache) get(key string) ([]*sseEvent, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	elem, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*responseCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		rc.lru.Remove(elem)
+		delete(rc.entries, key)
+		return nil, false
+	}
+	rc.lru.MoveToFront(elem)
+	return entry.events, true
+}
+
+func (rc *responseCache) set(key string, events []*sseEvent, config ResponseCacheConfig) {
+	entry := &responseCacheEntry{key: key, events: events}
+	if config.TTL > 0 {
+		entry.expires = time.Now().Add(config.TTL)
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if elem, ok := rc.entries[key]; ok {
+		rc.lru.Remove(elem)
+	}
+	rc.entries[key] = rc.lru.PushFront(entry)
+	for config.MaxEntries > 0 && rc.lru.Len() > config.MaxEntries {
+		oldest := rc.lru.Remove(rc.lru.Back()).(*responseCacheEntry)
+		delete(rc.entries, oldest.key)
+	}
+}
+
+// serveCachedResponse answers the request from the response cache if it
+// holds a response for body, the request as it is about to be sent upstream.
+// On a miss, the response is recorded for next time if it is cacheable.
+func serveCachedResponse(r *http.Request, w http.ResponseWriter, state *runtimeState, params *anthropic.BetaMessageNewParams, body []byte) bool {
+	config := state.config.ResponseCache
+	if !config.cacheable(params) {
+		return false
+	}
+
+	canonical, err := canonicalizeRequest(body, responseCacheFields)
+	if err != nil {
+		printRed(r.Context(), "Error canonicalizing request for the response cache: %v\n", err)
+		return false
+	}
+	// Betas can change the response to the same body, e.g. interleaved
+	// thinking, so they are part of the key.
+	key := hashRequestBody(append(canonical, "\n"+strings.Join(betaFeatures(r.Header), ",")...))
+
+	if events, ok := globalResponseCache.get(key); ok {
+		printGreen(r.Context(), "Response cache hit! Replaying %d cached events\n", len(events))
+		writeSyntheticResponse(r.Context(), w, events, isStreaming(params))
+		return true
+	}
+
+	printYellow(r.Context(), "Response cache miss. Response will be recorded\n")
+	ctx := addResponseRecordingToContext(r.Context(), &responseRecording{key: key, config: config})
+	*r = *r.WithContext(ctx)
+	return false
+}
+
+// betaFeatures returns the betas requested in the anthropic-beta headers,
+// sorted and without duplicates.
+func betaFeatures(header http.Header) []string {
+	var betas []string
+	for _, value := range header.Values("anthropic-beta") {
+		for _, beta := range strings.Split(value, ",") {
+			if beta = strings.TrimSpace(beta); beta != "" {
+				betas = append(betas, beta)
+			}
+		}
+	}
+	slices.Sort(betas)
+	return slices.Compact(betas)
+}
+
+// responseRecording collects the events of a response on its way to the
+// client.
+type responseRecording struct {
+	key    string
+	config ResponseCacheConfig
+	events []*sseEvent
+}
+
+const responseRecordingKey contextKey = "response_recording"
+
+func addResponseRecordingToContext(ctx context.Context, rec *responseRecording) context.Context {
+	return context.WithValue(ctx, responseRecordingKey, rec)
+}
+
+func getResponseRecordingFromContext(ctx context.Context) (*responseRecording, bool) {
+	rec, ok := ctx.Value(responseRecordingKey).(*responseRecording)
+	return rec, ok
+}
+
+// responseCacheRecorder stores responses in the response cache once they are
+// complete. It runs last so it records exactly what the client receives.
+type responseCacheRecorder struct{}
+
+func (responseCacheRecorder) Name() string { return "response_cache" }
+
+func (responseCacheRecorder) Order() int { return 1000 }
+
+func (responseCacheRecorder) Applies(rc *responseContext) bool {
+	_, ok := getResponseRecordingFromContext(rc.request.Context())
+	return ok
+}
+
+func (responseCacheRecorder) TransformEvent(rc *responseContext, ev *sseEvent) bool {
+	rec, _ := getResponseRecordingFromContext(rc.request.Context())
+	if rec.events == nil && ev.Event != "message_start" && ev.Event != "message" {
+		// Either a stream we didn't see start or one that already failed.
+		return true
+	}
+
+	switch ev.Event {
+	case "error":
+		rec.events = nil
+	case "message", "message_stop":
+		rec.events = append(rec.events, &sseEvent{Event: ev.Event, Data: bytes.Clone(ev.Data)})
+		globalResponseCache.set(rec.key, rec.events, rec.config)
+		printYellow(rc.request.Context(), "Cached response with %d events\n", len(rec.events))
+		rec.events = nil
+	default:
+		rec.events = append(rec.events, &sseEvent{Event: ev.Event, Data: bytes.Clone(ev.Data)})
+	}
+	return true
+}
+
+func init() {
+	registerResponseTransformer(responseCacheRecorder{})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+)
+
+func TestBetaFeatures(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"none", nil, nil},
+		{"one", []string{"prompt-caching-2024-07-31"}, []string{"prompt-caching-2024-07-31"}},
+		{"order", []string{"interleaved-thinking-2025-05-14,extended-cache-ttl-2025-04-11"},
+			[]string{"extended-cache-ttl-2025-04-11", "interleaved-thinking-2025-05-14"}},
+		{"repeated headers", []string{"interleaved-thinking-2025-05-14", " extended-cache-ttl-2025-04-11 , interleaved-thinking-2025-05-14,"},
+			[]string{"extended-cache-ttl-2025-04-11", "interleaved-thinking-2025-05-14"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, v := range tt.values {
+				header.Add("Anthropic-Beta", v)
+			}
+			if got := betaFeatures(header); !slices.Equal(got, tt.want) {
+				t.Errorf("betaFeatures(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseCacheable(t *testing.T) {
+	enabled := ResponseCacheConfig{Enabled: true, Rules: []ResponseCacheRule{
+		{Models: []string{"claude-3-5-haiku*"}, System: "new conversation topic"},
+		{Models: []string{"claude-sonnet-4*"}, System: "/^Summarize/"},
+	}}
+	tests := []struct {
+		name        string
+		config      ResponseCacheConfig
+		model       anthropic.Model
+		system      string
+		temperature param.Opt[float64]
+		want        bool
+	}{
+		{"match", enabled, "claude-3-5-haiku-20241022", "Detect a new conversation topic.", anthropic.Float(0), true},
+		{"regex", enabled, "claude-sonnet-4-20250514", "Summarize the conversation.", anthropic.Float(0), true},
+		{"disabled", ResponseCacheConfig{Rules: enabled.Rules}, "claude-3-5-haiku-20241022", "new conversation topic", anthropic.Float(0), false},
+		{"no rules", ResponseCacheConfig{Enabled: true}, "claude-3-5-haiku-20241022", "new conversation topic", anthropic.Float(0), false},
+		{"no temperature", enabled, "claude-3-5-haiku-20241022", "new conversation topic", param.Opt[float64]{}, false},
+		{"temperature above zero", enabled, "claude-3-5-haiku-20241022", "new conversation topic", anthropic.Float(0.001), false},
+		{"other model", enabled, "claude-opus-4-20250514", "new conversation topic", anthropic.Float(0), false},
+		{"other system prompt", enabled, "claude-3-5-haiku-20241022", "You are Claude Code.", anthropic.Float(0), false},
+		{"regex not anchored", enabled, "claude-sonnet-4-20250514", "Please Summarize the conversation.", anthropic.Float(0), false},
+		{"rule for any model", ResponseCacheConfig{Enabled: true, Rules: []ResponseCacheRule{{System: "topic"}}}, "claude-opus-4-20250514", "new conversation topic", anthropic.Float(0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := &anthropic.BetaMessageNewParams{
+				Model:       tt.model,
+				System:      []anthropic.BetaTextBlockParam{{Text: tt.system}},
+				Temperature: tt.temperature,
+			}
+			if got := tt.config.cacheable(params); got != tt.want {
+				t.Errorf("cacheable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestResponseCache() *responseCache {
+	return &responseCache{entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	rc := newTestResponseCache()
+	config := ResponseCacheConfig{MaxEntries: 2}
+	events := func(key string) []*sseEvent {
+		return []*sseEvent{{Event: "message", Data: []byte(`{"id":"` + key + `"}`)}}
+	}
+
+	rc.set("a", events("a"), config)
+	rc.set("b", events("b"), config)
+	// Using a makes b the least recently used entry.
+	if _, ok := rc.get("a"); !ok {
+		t.Fatal("a missing")
+	}
+	rc.set("c", events("c"), config)
+	if _, ok := rc.get("b"); ok {
+		t.Error("least recently used entry kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if got, ok := rc.get(key); !ok || string(got[0].Data) != string(events(key)[0].Data) {
+			t.Errorf("get(%s) = %v, %v", key, got, ok)
+		}
+	}
+
+	// Setting a key again replaces the entry instead of adding one.
+	rc.set("a", events("a2"), config)
+	if rc.lru.Len() != 2 {
+		t.Errorf("%d entries after replacing one, want 2", rc.lru.Len())
+	}
+	if got, _ := rc.get("a"); string(got[0].Data) != `{"id":"a2"}` {
+		t.Errorf("replaced entry = %s", got[0].Data)
+	}
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	rc := newTestResponseCache()
+	rc.set("forever", nil, ResponseCacheConfig{})
+	rc.set("short", nil, ResponseCacheConfig{TTL: time.Minute})
+	if entry := rc.entries["forever"].Value.(*responseCacheEntry); !entry.expires.IsZero() {
+		t.Errorf("entry without a TTL expires at %v", entry.expires)
+	}
+	if _, ok := rc.get("short"); !ok {
+		t.Fatal("fresh entry missing")
+	}
+
+	rc.entries["short"].Value.(*responseCacheEntry).expires = time.Now().Add(-time.Second)
+	if _, ok := rc.get("short"); ok {
+		t.Error("expired entry returned")
+	}
+	if _, ok := rc.entries["short"]; ok || rc.lru.Len() != 1 {
+		t.Error("expired entry not removed")
+	}
+	if _, ok := rc.get("forever"); !ok {
+		t.Error("entry without a TTL missing")
+	}
+}
+
+func TestResponseCacheRecorder(t *testing.T) {
+	stream := string(streamedText("Hello"))
+	tests := []struct {
+		name       string
+		stream     string
+		wantEvents int
+	}{
+		{"stream", stream, len(testEvents(t, stream))},
+		{"message", "event: message\ndata: " + testMessageBody + "\n\n", 1},
+		{"error", strings.Replace(stream, "event: message_delta", "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\nevent: message_delta", 1), 0},
+		{"no message_start", strings.SplitN(stream, "\n\n", 2)[1], 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := "recorder test " + tt.name
+			rec := &responseRecording{key: key}
+			r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			r = r.WithContext(addResponseRecordingToContext(context.Background(), rec))
+			rc := &responseContext{request: r}
+
+			for _, ev := range testEvents(t, tt.stream) {
+				if !(responseCacheRecorder{}).TransformEvent(rc, ev) {
+					t.Errorf("%s event dropped", ev.Event)
+				}
+			}
+			got, ok := globalResponseCache.get(key)
+			if ok != (tt.wantEvents > 0) || len(got) != tt.wantEvents {
+				t.Errorf("cached %d events (%v), want %d", len(got), ok, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestReplayCachedResponse(t *testing.T) {
+	const message = `{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-haiku-20241022",` +
+		`"content":[{"type":"text","text":"Let me look."},{"type":"tool_use","id":"toolu_1","name":"Read","input":{"path":"main.go"}}],` +
+		`"stop_reason":"tool_use","stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":7}}`
+
+	t.Run("stream to message", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		writeSyntheticResponse(context.Background(), w, testEvents(t, string(streamedText("Hello, world"))), false)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %s", ct)
+		}
+		var got struct {
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+			StopReason string `json:"stop_reason"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Content) != 1 || got.Content[0].Text != "Hello, world" || got.StopReason != "end_turn" {
+			t.Errorf("replayed message = %s", w.Body)
+		}
+	})
+
+	t.Run("message to stream", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		writeSyntheticResponse(context.Background(), w, []*sseEvent{{Event: "message", Data: []byte(message)}}, true)
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Content-Type = %s", ct)
+		}
+		events := testEvents(t, w.Body.String())
+		if first, last := events[0].Event, events[len(events)-1].Event; first != "message_start" || last != "message_stop" {
+			t.Errorf("stream runs from %s to %s", first, last)
+		}
+		folded, err := foldMessageEvents(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, want any
+		json.Unmarshal(folded, &got)
+		json.Unmarshal([]byte(message), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("stream folds back into %s\nwant %s", folded, message)
+		}
+	})
+}
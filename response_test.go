@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+const testMessageBody = `{"model":"claude-sonnet-4-20250514","content":[],"usage":{"input_tokens":10,"output_tokens":2}}`
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInterceptResponseContentEncoding(t *testing.T) {
+	stream := streamedText("Hello")
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		// What the client receives.
+		want         []byte
+		wantEncoding string
+		wantUsage    bool
+	}{
+		{"identity", "application/json", "", []byte(testMessageBody), []byte(testMessageBody), "", true},
+		{"gzip", "application/json", "gzip", gzipped(t, []byte(testMessageBody)), []byte(testMessageBody), "", true},
+		{"gzip stream", "text/event-stream", "gzip", gzipped(t, stream), stream, "", true},
+		{"br", "application/json", "br", []byte("\x1b\x05\x00"), []byte("\x1b\x05\x00"), "br", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			info := newRequestInfo(r)
+			r = r.WithContext(addRequestInfoToContext(r.Context(), info))
+
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{},
+				Body:          io.NopCloser(bytes.NewReader(tt.body)),
+				ContentLength: int64(len(tt.body)),
+				Request:       r,
+			}
+			resp.Header.Set("Content-Type", tt.contentType)
+			resp.Header.Set("Content-Length", strconv.Itoa(len(tt.body)))
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			if err := interceptResponse(resp); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if encoding := resp.Header.Get("Content-Encoding"); encoding != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", encoding, tt.wantEncoding)
+			}
+			if length := resp.Header.Get("Content-Length"); length != "" && length != strconv.Itoa(len(got)) {
+				t.Errorf("Content-Length = %s for a %d byte body", length, len(got))
+			}
+			if info.hasUsage != tt.wantUsage {
+				t.Errorf("usage recorded = %v, want %v", info.hasUsage, tt.wantUsage)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+// sseEvent is one server-sent event of a streamed Messages API response,
+// e.g. message_start, content_block_delta or message_delta. Data holds the
+// JSON payload exactly as received.
+type sseEvent struct {
+	Event string
+	Data  []byte
+}
+
+// decode unmarshals the payload into v. Numbers decode as json.Number when v
+// is untyped so that re-encoding doesn't change them.
+func (e *sseEvent) decode(v any) error {
+	dec := json.NewDecoder(bytes.NewReader(e.Data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// encode replaces the payload with the JSON encoding of v.
+func (e *sseEvent) encode(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.Data = data
+	return nil
+}
+
+// bytes returns the wire form of the event, using the same framing as the
+// Anthropic API.
+func (e *sseEvent) bytes() []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(e.Event) + len(e.Data) + 16)
+	// Data-only events stay data-only.
+	if e.Event != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(e.Event)
+		buf.WriteByte('\n')
+	}
+	// Every line of the payload needs its own data field.
+	for _, line := range bytes.Split(e.Data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// writeSSEEvent writes a whole event with a single Write so that a flushing
+// writer sends it as one chunk.
+func writeSSEEvent(w io.Writer, e *sseEvent) error {
+	_, err := w.Write(e.bytes())
+	return err
+}
+
+// sseReader parses a text/event-stream body into events.
+type sseReader struct {
+	r *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{r: bufio.NewReader(r)}
+}
+
+// next returns the next event. At the end of the stream it returns io.EOF;
+// a trailing event without a terminating blank line is still returned first.
+// Any other read error is returned as is.
+func (sr *sseReader) next() (*sseEvent, error) {
+	var (
+		ev      sseEvent
+		data    [][]byte
+		started bool
+	)
+	for {
+		line, err := sr.r.ReadBytes('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+			// A read error loses whatever was read of the event so far.
+			if started && errors.Is(err, io.EOF) {
+				ev.Data = bytes.Join(data, []byte("\n"))
+				return &ev, nil
+			}
+			return nil, err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if started {
+				ev.Data = bytes.Join(data, []byte("\n"))
+				return &ev, nil
+			}
+			continue
+		}
+		if line[0] == ':' {
+			// Comment.
+			continue
+		}
+
+		field, value, _ := strings.Cut(string(line), ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.Event = value
+			started = true
+		case "data":
+			data = append(data, []byte(value))
+			started = true
+		}
+	}
+}
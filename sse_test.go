@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func readAllEvents(t *testing.T, r io.Reader) ([]sseEvent, error) {
+	t.Helper()
+	var events []sseEvent
+	sr := newSSEReader(r)
+	for {
+		ev, err := sr.next()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, *ev)
+	}
+}
+
+func TestSSEReaderNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []sseEvent
+	}{
+		{
+			name:   "events",
+			stream: "event: ping\ndata: {\"type\":\"ping\"}\n\nevent: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+			want: []sseEvent{
+				{Event: "ping", Data: []byte(`{"type":"ping"}`)},
+				{Event: "message_stop", Data: []byte(`{"type":"message_stop"}`)},
+			},
+		},
+		{
+			name:   "multi-line data",
+			stream: "event: note\ndata: first\ndata:second\ndata: \n\n",
+			want:   []sseEvent{{Event: "note", Data: []byte("first\nsecond\n")}},
+		},
+		{
+			name:   "comments",
+			stream: ": keep-alive\n\nevent: ping\n: in between\ndata: {}\n\n",
+			want:   []sseEvent{{Event: "ping", Data: []byte("{}")}},
+		},
+		{
+			name:   "CRLF",
+			stream: "event: ping\r\ndata: {}\r\n\r\nevent: message_stop\r\ndata: {}\r\n\r\n",
+			want: []sseEvent{
+				{Event: "ping", Data: []byte("{}")},
+				{Event: "message_stop", Data: []byte("{}")},
+			},
+		},
+		{
+			name:   "no trailing blank line",
+			stream: "event: ping\ndata: {}\n\nevent: message_stop\ndata: {}",
+			want: []sseEvent{
+				{Event: "ping", Data: []byte("{}")},
+				{Event: "message_stop", Data: []byte("{}")},
+			},
+		},
+		{
+			name:   "data only",
+			stream: "data: {}\n\n",
+			want:   []sseEvent{{Data: []byte("{}")}},
+		},
+		{
+			name:   "unknown fields",
+			stream: "id: 1\nretry: 1000\nevent: ping\ndata: {}\n\n",
+			want:   []sseEvent{{Event: "ping", Data: []byte("{}")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One byte at a time, so lines arrive in pieces.
+			got, err := readAllEvents(t, iotest.OneByteReader(strings.NewReader(tt.stream)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d events %q, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if got[i].Event != tt.want[i].Event || string(got[i].Data) != string(tt.want[i].Data) {
+					t.Errorf("event %d = %s %q, want %s %q", i, got[i].Event, got[i].Data, tt.want[i].Event, tt.want[i].Data)
+				}
+			}
+		})
+	}
+}
+
+func TestSSEReaderReadError(t *testing.T) {
+	errBroken := errors.New("connection reset")
+	r := io.MultiReader(
+		strings.NewReader("event: ping\ndata: {}\n\nevent: content_block_delta\ndata: {\"ty"),
+		iotest.ErrReader(errBroken),
+	)
+	got, err := readAllEvents(t, r)
+	if !errors.Is(err, errBroken) {
+		t.Errorf("error = %v, want %v", err, errBroken)
+	}
+	if len(got) != 1 || got[0].Event != "ping" {
+		t.Errorf("events before the error = %q, want just the ping", got)
+	}
+}
+
+func TestSSEEventBytes(t *testing.T) {
+	tests := []struct {
+		ev   sseEvent
+		want string
+	}{
+		{sseEvent{Event: "ping", Data: []byte("{}")}, "event: ping\ndata: {}\n\n"},
+		{sseEvent{Data: []byte("{}")}, "data: {}\n\n"},
+		{sseEvent{Event: "note", Data: []byte("first\nsecond")}, "event: note\ndata: first\ndata: second\n\n"},
+	}
+	for _, tt := range tests {
+		got := string(tt.ev.bytes())
+		if got != tt.want {
+			t.Errorf("bytes() = %q, want %q", got, tt.want)
+		}
+		// What is written reads back the same.
+		events, err := readAllEvents(t, strings.NewReader(got))
+		if err != nil || len(events) != 1 || events[0].Event != tt.ev.Event || string(events[0].Data) != string(tt.ev.Data) {
+			t.Errorf("%q reads back as %q, %v", got, events, err)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Responses the booster makes up itself, canned or cached, are kept as the
+// events of a streamed response and written by writeSyntheticResponse, which
+// turns them into a single message when the client didn't ask for a stream.
+
+// isStreaming reports whether the client asked for a streamed response. The
+// field lives in the extra fields, see parseMessageParams.
+func isStreaming(params *anthropic.BetaMessageNewParams) bool {
+	stream, _ := params.ExtraFields()["stream"].(bool)
+	return stream
+}
+
+// textMessageEvents returns the event stream of a reply from model made of
+// a single text block, in the same sequence the API uses.
+func textMessageEvents(model anthropic.Model, text string) []*sseEvent {
+	events := textMessagePrologue(model)
+	events = append(events, textDeltaEvent(text))
+	return append(events, textMessageEpilogue(usage{})...)
+}
+
+// textMessagePrologue returns the events that open a text reply, up to the
+// first text delta.
+func textMessagePrologue(model anthropic.Model) []*sseEvent {
+	// Generate random ID
+	randomBytes := make([]byte, 8)
+	rand.Read(randomBytes)
+	messageID := fmt.Sprintf("msg_%x", randomBytes)
+
+	return []*sseEvent{
+		newSSEEvent("message_start", map[string]any{
+			"type": "message_start",
+			"message": map[string]any{
+				"id":            messageID,
+				"type":          "message",
+				"role":          "assistant",
+				"model":         model,
+				"content":       []any{},
+				"stop_reason":   nil,
+				"stop_sequence": nil,
+				"usage": map[string]any{
+					"input_tokens":                0,
+					"cache_creation_input_tokens": 0,
+					"cache_read_input_tokens":     0,
+					"output_tokens":               0,
+					"service_tier":                "standard",
+				},
+			},
+		}),
+		newSSEEvent("content_block_start", map[string]any{
+			"type":  "content_block_start",
+			"index": 0,
+			"content_block": map[string]any{
+				"type": "text",
+				"text": "",
+			},
+		}),
+		newSSEEvent("ping", map[string]any{
+			"type": "ping",
+		}),
+	}
+}
+
+func textDeltaEvent(text string) *sseEvent {
+	return newSSEEvent("content_block_delta", map[string]any{
+		"type":  "content_block_delta",
+		"index": 0,
+		"delta": map[string]any{
+			"type": "text_delta",
+			"text": text,
+		},
+	})
+}
+
+// errorEvent is the event the API ends a stream with when it fails after
+// the response has started.
+func errorEvent(errType, message string) *sseEvent {
+	return newSSEEvent("error", map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
+
+// textMessageEpilogue returns the events that close a text reply. u is the
+// final usage of the reply.
+func textMessageEpilogue(u usage) []*sseEvent {
+	return []*sseEvent{
+		newSSEEvent("content_block_stop", map[string]any{
+			"type":  "content_block_stop",
+			"index": 0,
+		}),
+		newSSEEvent("message_delta", map[string]any{
+			"type": "message_delta",
+			"delta": map[string]any{
+				"stop_reason":   "end_turn",
+				"stop_sequence": nil,
+			},
+			"usage": u,
+		}),
+		newSSEEvent("message_stop", map[string]any{
+			"type": "message_stop",
+		}),
+	}
+}
+
+func newSSEEvent(event string, data any) *sseEvent {
+	ev := &sseEvent{Event: event}
+	ev.encode(data)
+	return ev
+}
+
+// writeSyntheticResponse answers the client with events, as a stream if
+// stream is set and as a single message JSON body otherwise. A lone
+// "message" event, as recorded from a non-streaming response, is already
+// the body, and is taken apart into events for a stream.
+func writeSyntheticResponse(ctx context.Context, w http.ResponseWriter, events []*sseEvent, stream bool) {
+	if !stream {
+		body, err := foldMessageEvents(events)
+		if err != nil {
+			printRed(ctx, "Error building message from events: %v\n", err)
+			http.Error(w, "Error building response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		return
+	}
+
+	if len(events) == 1 && events[0].Event == "message" {
+		unfolded, err := unfoldMessage(events[0])
+		if err != nil {
+			printRed(ctx, "Error building events from message: %v\n", err)
+			http.Error(w, "Error building response", http.StatusInternalServerError)
+			return
+		}
+		events = unfolded
+	}
+	startSyntheticStream(w)
+	writeSyntheticEvents(w, events)
+}
+
+func startSyntheticStream(w http.ResponseWriter) {
+	// Set SSE headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeSyntheticEvents writes and flushes events one at a time. It fails
+// once the client has gone away.
+func writeSyntheticEvents(w http.ResponseWriter, events []*sseEvent) error {
+	flusher, _ := w.(http.Flusher)
+	for _, ev := range events {
+		if err := writeSSEEvent(w, ev); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+// foldMessageEvents assembles the message a stream of events describes,
+// the way the API would have returned it without streaming.
+func foldMessageEvents(events []*sseEvent) ([]byte, error) {
+	if len(events) == 1 && events[0].Event == "message" {
+		return events[0].Data, nil
+	}
+
+	var message map[string]any
+	var blocks []map[string]any
+	var partialJSON map[int]string
+	for _, ev := range events {
+		var payload map[string]any
+		if err := ev.decode(&payload); err != nil {
+			return nil, fmt.Errorf("decoding %s event: %w", ev.Event, err)
+		}
+
+		switch ev.Event {
+		case "error":
+			e, _ := payload["error"].(map[string]any)
+			return nil, fmt.Errorf("stream failed: %v", e["message"])
+		case "message_start":
+			message, _ = payload["message"].(map[string]any)
+		case "content_block_start":
+			block, _ := payload["content_block"].(map[string]any)
+			blocks = append(blocks, block)
+		case "content_block_delta":
+			delta, _ := payload["delta"].(map[string]any)
+			if len(blocks) == 0 || delta == nil {
+				continue
+			}
+			block := blocks[len(blocks)-1]
+			switch delta["type"] {
+			case "text_delta":
+				block["text"] = fmt.Sprint(block["text"]) + fmt.Sprint(delta["text"])
+			case "thinking_delta":
+				block["thinking"] = fmt.Sprint(block["thinking"]) + fmt.Sprint(delta["thinking"])
+			case "signature_delta":
+				block["signature"] = delta["signature"]
+			case "input_json_delta":
+				if partialJSON == nil {
+					partialJSON = make(map[int]string)
+				}
+				partialJSON[len(blocks)-1] += fmt.Sprint(delta["partial_json"])
+			}
+		case "message_delta":
+			if message == nil {
+				continue
+			}
+			if delta, ok := payload["delta"].(map[string]any); ok {
+				for k, v := range delta {
+					message[k] = v
+				}
+			}
+			if u, ok := payload["usage"].(map[string]any); ok {
+				usage, _ := message["usage"].(map[string]any)
+				if usage == nil {
+					usage = make(map[string]any)
+					message["usage"] = usage
+				}
+				for k, v := range u {
+					usage[k] = v
+				}
+			}
+		}
+	}
+	if message == nil {
+		return nil, fmt.Errorf("no message_start event")
+	}
+
+	for i, raw := range partialJSON {
+		var input any
+		if err := json.Unmarshal([]byte(raw), &input); err != nil {
+			return nil, fmt.Errorf("decoding tool input: %w", err)
+		}
+		blocks[i]["input"] = input
+	}
+	content := make([]any, len(blocks))
+	for i, block := range blocks {
+		content[i] = block
+	}
+	message["content"] = content
+	return json.Marshal(message)
+}
+
+// unfoldMessage is the reverse of foldMessageEvents: it returns the events
+// the API would have streamed for the message in a "message" event, with
+// each content block in a single delta.
+func unfoldMessage(ev *sseEvent) ([]*sseEvent, error) {
+	var message map[string]any
+	if err := ev.decode(&message); err != nil {
+		return nil, fmt.Errorf("decoding message: %w", err)
+	}
+	content, _ := message["content"].([]any)
+	stopReason, stopSequence := message["stop_reason"], message["stop_sequence"]
+
+	start := maps.Clone(message)
+	start["content"] = []any{}
+	start["stop_reason"] = nil
+	start["stop_sequence"] = nil
+	events := []*sseEvent{newSSEEvent("message_start", map[string]any{
+		"type":    "message_start",
+		"message": start,
+	})}
+
+	for i, c := range content {
+		block, ok := c.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("content block %d is not an object", i)
+		}
+		blockStart := maps.Clone(block)
+		var deltas []map[string]any
+		switch block["type"] {
+		case "text":
+			blockStart["text"] = ""
+			deltas = append(deltas, map[string]any{"type": "text_delta", "text": block["text"]})
+		case "thinking":
+			blockStart["thinking"] = ""
+			blockStart["signature"] = ""
+			deltas = append(deltas,
+				map[string]any{"type": "thinking_delta", "thinking": block["thinking"]},
+				map[string]any{"type": "signature_delta", "signature": block["signature"]})
+		case "tool_use", "server_tool_use":
+			input, err := json.Marshal(block["input"])
+			if err != nil {
+				return nil, fmt.Errorf("encoding tool input: %w", err)
+			}
+			blockStart["input"] = map[string]any{}
+			deltas = append(deltas, map[string]any{"type": "input_json_delta", "partial_json": string(input)})
+		}
+
+		events = append(events, newSSEEvent("content_block_start", map[string]any{
+			"type":          "content_block_start",
+			"index":         i,
+			"content_block": blockStart,
+		}))
+		for _, delta := range deltas {
+			events = append(events, newSSEEvent("content_block_delta", map[string]any{
+				"type":  "content_block_delta",
+				"index": i,
+				"delta": delta,
+			}))
+		}
+		events = append(events, newSSEEvent("content_block_stop", map[string]any{
+			"type":  "content_block_stop",
+			"index": i,
+		}))
+	}
+
+	return append(events,
+		newSSEEvent("message_delta", map[string]any{
+			"type": "message_delta",
+			"delta": map[string]any{
+				"stop_reason":   stopReason,
+				"stop_sequence": stopSequence,
+			},
+			"usage": message["usage"],
+		}),
+		newSSEEvent("message_stop", map[string]any{
+			"type": "message_stop",
+		}),
+	), nil
+}
@@ -1,32 +1,340 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
+// TokenCacheConfig bounds the cache of count_tokens responses. Zero disables
+// the corresponding limit.
+type TokenCacheConfig struct {
+	MaxEntries int           `yaml:"max_entries"`
+	MaxBytes   int64         `yaml:"max_bytes"`
+	TTL        time.Duration `yaml:"ttl"`
+	// How often to print the cache counters. Zero turns it off.
+	ReportInterval time.Duration `yaml:"report_interval"`
+	// How long a request waits for an identical one already in flight
+	// before going upstream itself. Zero turns coalescing off.
+	CoalesceTimeout time.Duration `yaml:"coalesce_timeout"`
+	// Directory to persist the cache in across restarts. Empty keeps it in
+	// memory only. Only read at startup.
+	Dir string `yaml:"dir"`
+}
+
+func (c TokenCacheConfig) validate() error {
+	if c.MaxEntries < 0 || c.MaxBytes < 0 || c.TTL < 0 || c.ReportInterval < 0 || c.CoalesceTimeout < 0 {
+		return errors.New("token_cache: limits must not be negative")
+	}
+	return nil
+}
+
+// tokenCache is an LRU cache of count_tokens response bodies keyed by request
+// hash. Entries expire after the configured TTL, and the least recently used
+// ones are evicted once the entry or byte limit is exceeded.
 type tokenCache struct {
-	cache map[string][]byte // hash -> response body
-	mutex sync.RWMutex
+	limits func() TokenCacheConfig
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	bytes   int64
+	stats   tokenCacheStats
+	// Set whenever the counters change, cleared by the periodic report.
+	dirty bool
+	// Append log every new entry is written through to, if persistence is
+	// enabled.
+	store *os.File
+	path  string
+	// Bytes appended to the store since it was last rewritten.
+	appended int64
+}
+
+type tokenCacheEntry struct {
+	hash     string
+	response []byte
+	expires  time.Time // zero if the entry never expires
 }
 
-var globalTokenCache = &tokenCache{
-	cache: make(map[string][]byte),
+func (e *tokenCacheEntry) size() int64 {
+	return int64(len(e.hash) + len(e.response))
 }
 
+type tokenCacheStats struct {
+	hits, misses, evictions, expirations int
+}
+
+func newTokenCache(limits func() TokenCacheConfig) *tokenCache {
+	return &tokenCache{
+		limits:  limits,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+var globalTokenCache = newTokenCache(func() TokenCacheConfig {
+	return liveState.Load().config.TokenCache
+})
+
 func (tc *tokenCache) get(hash string) ([]byte, bool) {
-	tc.mutex.RLock()
-	defer tc.mutex.RUnlock()
-	response, exists := tc.cache[hash]
-	return response, exists
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.dirty = true
+
+	elem, exists := tc.entries[hash]
+	if !exists {
+		tc.stats.misses++
+		return nil, false
+	}
+	entry := elem.Value.(*tokenCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		tc.remove(elem)
+		tc.stats.expirations++
+		tc.stats.misses++
+		return nil, false
+	}
+	tc.lru.MoveToFront(elem)
+	tc.stats.hits++
+	return entry.response, true
 }
 
 func (tc *tokenCache) set(hash string, response []byte) {
+	limits := tc.limits()
+	entry := &tokenCacheEntry{hash: hash, response: bytes.Clone(response)}
+	if limits.TTL > 0 {
+		entry.expires = time.Now().Add(limits.TTL)
+	}
+	if limits.MaxBytes > 0 && entry.size() > limits.MaxBytes {
+		return
+	}
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.dirty = true
+
+	if elem, exists := tc.entries[hash]; exists {
+		tc.remove(elem)
+	}
+	tc.insert(entry, limits)
+	if tc.store == nil {
+		return
+	}
+	n, err := writeTokenCacheRecord(tc.store, entry)
+	if err != nil {
+		printRed(context.Background(), "Error persisting token count cache, continuing in memory only: %v\n", err)
+		tc.store.Close()
+		tc.store = nil
+		return
+	}
+	tc.appended += int64(n)
+	if tc.appended > tokenCacheCompactMinBytes && tc.appended > tokenCacheCompactRatio*tc.bytes {
+		if err := tc.rewrite(); err != nil && tc.store == nil {
+			printRed(context.Background(), "Error compacting token count cache, continuing in memory only: %v\n", err)
+		} else if err != nil {
+			printWarning(context.Background(), "Error compacting token count cache %s: %v\n", tc.path, err)
+		}
+		// Either way, wait for another batch of appends before trying again.
+		tc.appended = 0
+	}
+}
+
+// insert adds entry as the most recently used one and evicts whatever no
+// longer fits. The caller must hold the mutex.
+func (tc *tokenCache) insert(entry *tokenCacheEntry, limits TokenCacheConfig) {
+	tc.entries[entry.hash] = tc.lru.PushFront(entry)
+	tc.bytes += entry.size()
+
+	for (limits.MaxEntries > 0 && tc.lru.Len() > limits.MaxEntries) ||
+		(limits.MaxBytes > 0 && tc.bytes > limits.MaxBytes) {
+		tc.remove(tc.lru.Back())
+		tc.stats.evictions++
+	}
+}
+
+// remove drops elem from the cache. The caller must hold the mutex.
+func (tc *tokenCache) remove(elem *list.Element) {
+	entry := tc.lru.Remove(elem).(*tokenCacheEntry)
+	delete(tc.entries, entry.hash)
+	tc.bytes -= entry.size()
+}
+
+func (tc *tokenCache) String() string {
 	tc.mutex.Lock()
 	defer tc.mutex.Unlock()
-	tc.cache[hash] = response
+	return fmt.Sprintf("%d entries, %d bytes, %d hits, %d misses, %d evictions, %d expired",
+		tc.lru.Len(), tc.bytes, tc.stats.hits, tc.stats.misses, tc.stats.evictions, tc.stats.expirations)
+}
+
+// The on-disk cache is a JSON lines file: a header carrying the format version
+// followed by one record per entry, oldest first. Bump tokenCacheVersion
+// whenever the record format or the request hashing changes; files with any
+// other version are discarded.
+const (
+	tokenCacheVersion = 2
+	tokenCacheFile    = "token_cache.jsonl"
+)
+
+// Overwritten and evicted entries stay in the append log until it is
+// rewritten, at startup or once the records appended since outgrow the live
+// entries by tokenCacheCompactRatio. Small logs are left alone.
+const (
+	tokenCacheCompactRatio    = 4
+	tokenCacheCompactMinBytes = 1 << 20
+)
+
+type tokenCacheHeader struct {
+	Version int `json:"version"`
+}
+
+type tokenCacheRecord struct {
+	Hash     string    `json:"hash"`
+	Response string    `json:"response"`
+	Expires  time.Time `json:"expires"`
+}
+
+func writeTokenCacheRecord(w io.Writer, entry *tokenCacheEntry) (int, error) {
+	line, err := json.Marshal(tokenCacheRecord{Hash: entry.hash, Response: string(entry.response), Expires: entry.expires})
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(append(line, '\n'))
+}
+
+// open loads the cache persisted in dir and writes new entries through to
+// it from then on. Loading compacts the file, leaving out entries that have
+// expired, were overwritten or no longer fit the limits.
+func (tc *tokenCache) open(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, tokenCacheFile)
+
+	limits := tc.limits()
+	now := time.Now()
+	loaded, discarded := 0, 0
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16<<20)
+		var header tokenCacheHeader
+		if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Version != tokenCacheVersion {
+			printWarning(context.Background(), "Discarding token count cache %s with unknown format\n", path)
+		} else {
+			for scanner.Scan() {
+				var rec tokenCacheRecord
+				if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Hash == "" {
+					discarded++
+					continue
+				}
+				if !rec.Expires.IsZero() && now.After(rec.Expires) {
+					discarded++
+					continue
+				}
+				if elem, exists := tc.entries[rec.Hash]; exists {
+					tc.remove(elem)
+				}
+				tc.insert(&tokenCacheEntry{hash: rec.Hash, response: []byte(rec.Response), expires: rec.Expires}, limits)
+				loaded++
+			}
+			if err := scanner.Err(); err != nil {
+				printWarning(context.Background(), "Token count cache %s truncated: %v\n", path, err)
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// Evictions while loading are not worth reporting as cache activity.
+	tc.stats.evictions = 0
+
+	tc.path = path
+	if err := tc.rewrite(); err != nil {
+		return err
+	}
+	printGreen(context.Background(), "Loaded %d token counts from %s (%d stale records dropped)\n", tc.lru.Len(), path, loaded-tc.lru.Len()+discarded)
+	return nil
+}
+
+// rewrite writes the live entries to a fresh file, swaps it in for the
+// store and appends to it from then on. The caller must hold the mutex.
+func (tc *tokenCache) rewrite() error {
+	tmp, err := os.CreateTemp(filepath.Dir(tc.path), tokenCacheFile+".*")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	w := bufio.NewWriter(tmp)
+	err = json.NewEncoder(w).Encode(tokenCacheHeader{Version: tokenCacheVersion})
+	for elem := tc.lru.Back(); elem != nil && err == nil; elem = elem.Prev() {
+		entry := elem.Value.(*tokenCacheEntry)
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			_, err = writeTokenCacheRecord(w, entry)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), tc.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// The old store now points at the replaced file.
+	if tc.store != nil {
+		tc.store.Close()
+		tc.store = nil
+	}
+	store, err := os.OpenFile(tc.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	tc.store = store
+	tc.appended = 0
+	return nil
+}
+
+// reportTokenCacheStatsPeriodically prints the token cache counters at every
+// report interval in which the cache was used. It never returns.
+func reportTokenCacheStatsPeriodically(tc *tokenCache) {
+	for {
+		d := tc.limits().ReportInterval
+		if d <= 0 {
+			time.Sleep(watchInterval)
+			continue
+		}
+		time.Sleep(d)
+
+		tc.mutex.Lock()
+		dirty := tc.dirty
+		tc.dirty = false
+		tc.mutex.Unlock()
+
+		if dirty {
+			printBlue(context.Background(), "Token count cache: %s\n", tc)
+		}
+	}
 }
 
 func hashRequestBody(body []byte) string {
@@ -46,4 +354,4 @@ func addCacheHashToContext(ctx context.Context, hash string) context.Context {
 func getCacheHashFromContext(ctx context.Context) (string, bool) {
 	hash, ok := ctx.Value(cacheHashKey).(string)
 	return hash, ok
-}
\ No newline at end of file
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTokenCacheLRU(t *testing.T) {
+	tc := newTokenCache(func() TokenCacheConfig { return TokenCacheConfig{MaxEntries: 2} })
+	tc.set("a", []byte(`{"input_tokens":1}`))
+	tc.set("b", []byte(`{"input_tokens":2}`))
+	tc.get("a")
+	tc.set("c", []byte(`{"input_tokens":3}`))
+
+	if _, ok := tc.get("b"); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	for _, hash := range []string{"a", "c"} {
+		if _, ok := tc.get(hash); !ok {
+			t.Errorf("entry %s evicted", hash)
+		}
+	}
+	if tc.stats.evictions != 1 {
+		t.Errorf("%d evictions, want 1", tc.stats.evictions)
+	}
+}
+
+func TestTokenCacheCompaction(t *testing.T) {
+	dir := t.TempDir()
+	limits := func() TokenCacheConfig { return TokenCacheConfig{MaxEntries: 2} }
+	tc := newTokenCache(limits)
+	if err := tc.open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.store.Close()
+
+	// Overwrite the same two entries until the log is due for a rewrite.
+	response := []byte(`{"input_tokens":1,"padding":"` + strings.Repeat("x", 64<<10) + `"}`)
+	var last string
+	for i := 0; i < 2*tokenCacheCompactMinBytes/len(response); i++ {
+		last = []string{"a", "b"}[i%2]
+		tc.set(last, response)
+	}
+	tc.set("c", []byte(`{"input_tokens":3}`))
+
+	info, err := os.Stat(filepath.Join(dir, tokenCacheFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// At most the appends since the last rewrite on top of the live entries.
+	if max := int64(tokenCacheCompactMinBytes + 3*len(response)); info.Size() > max {
+		t.Errorf("log is %d bytes after compaction, want at most %d", info.Size(), max)
+	}
+
+	reloaded := newTokenCache(limits)
+	if err := reloaded.open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.store.Close()
+	for hash, want := range map[string][]byte{last: response, "c": []byte(`{"input_tokens":3}`)} {
+		if got, ok := reloaded.get(hash); !ok || !bytes.Equal(got, want) {
+			t.Errorf("entry %s not persisted", hash)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Token counting modes.
+const (
+	// Always ask the API.
+	tokenCountUpstream = "upstream"
+	// Answer every count_tokens request locally.
+	tokenCountLocal = "local"
+	// Ask the API, but answer locally when it is rate limited or overloaded.
+	tokenCountFallback = "fallback"
+)
+
+type TokenCountConfig struct {
+	Mode string `yaml:"mode"`
+	// Forward requests as the client sent them instead of running the
+	// transformers on them first.
+	Raw bool `yaml:"raw"`
+}
+
+func (c TokenCountConfig) validate() error {
+	switch c.Mode {
+	case tokenCountUpstream, tokenCountLocal, tokenCountFallback:
+		return nil
+	}
+	return fmt.Errorf("token_count: invalid mode %q, must be upstream, local or fallback", c.Mode)
+}
+
+// Tokens per image when the image size isn't known. The API charges about
+// width*height/750, which is ~1600 for a typical screenshot after resizing.
+const imageTokens = 1600
+
+// Claude's tokenizer isn't public. cl100k_base is a reasonable stand-in,
+// and the calibration below corrects for the difference.
+const localEncoding = "cl100k_base"
+
+// Characters per token for the heuristic used when the tokenizer can't be
+// loaded.
+const charsPerToken = 3.5
+
+// localTokenizer loads the BPE ranks embedded in the binary, so counting
+// locally never touches the network.
+var localTokenizer = sync.OnceValue(func() *tiktoken.Tiktoken {
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	enc, err := tiktoken.GetEncoding(localEncoding)
+	if err != nil {
+		printWarning(context.Background(), "Local tokenizer unavailable, estimating tokens from characters: %v\n", err)
+		return nil
+	}
+	return enc
+})
+
+func countTextTokens(text string) int {
+	if enc := localTokenizer(); enc != nil {
+		return len(enc.EncodeOrdinary(text))
+	}
+	return int(float64(utf8.RuneCountInString(text))/charsPerToken + 0.5)
+}
+
+// estimateTokens returns the uncalibrated local token count of a
+// count_tokens request. System and message content count as text; tool
+// definitions count as their JSON encoding, which is roughly what the model
+// sees.
+func estimateTokens(body []byte) (anthropic.Model, int, error) {
+	var request struct {
+		Model    anthropic.Model `json:"model"`
+		System   any             `json:"system"`
+		Messages any             `json:"messages"`
+		Tools    json.RawMessage `json:"tools"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", 0, err
+	}
+
+	var text strings.Builder
+	images := collectText(request.System, &text) + collectText(request.Messages, &text)
+	text.Write(request.Tools)
+	return request.Model, countTextTokens(text.String()) + images*imageTokens, nil
+}
+
+// Keys whose values aren't shown to the model as text.
+var nonTextKeys = map[string]bool{
+	"type":          true,
+	"id":            true,
+	"tool_use_id":   true,
+	"cache_control": true,
+	"source":        true,
+	"signature":     true,
+}
+
+// collectText appends every string in v that the model reads as text to
+// text and returns the number of images and documents found.
+func collectText(v any, text *strings.Builder) int {
+	images := 0
+	switch v := v.(type) {
+	case string:
+		text.WriteString(v)
+		text.WriteByte('\n')
+	case []any:
+		for _, item := range v {
+			images += collectText(item, text)
+		}
+	case map[string]any:
+		if v["type"] == "image" || v["type"] == "document" {
+			return 1
+		}
+		for key, value := range v {
+			if !nonTextKeys[key] {
+				images += collectText(value, text)
+			}
+		}
+	}
+	return images
+}
+
+// tokenCalibration learns, per model, how far local estimates are off from
+// the counts the API returns, as an exponential moving average of the ratio.
+// With a token cache dir, the factors are saved there every
+// tokenCalibrationSaveInterval and at shutdown, and survive restarts.
+var tokenCalibration = struct {
+	sync.Mutex
+	factors map[anthropic.Model]float64
+	path    string
+	// Set whenever a factor changes, cleared when the factors are saved.
+	dirty bool
+}{
+	factors: make(map[anthropic.Model]float64),
+}
+
+// Weight of the newest observation in the moving average.
+const calibrationWeight = 0.2
+
+const (
+	tokenCalibrationFile         = "token_calibration.json"
+	tokenCalibrationSaveInterval = time.Minute
+)
+
+func calibrateTokens(model anthropic.Model, estimate, actual int) {
+	if estimate <= 0 || actual <= 0 {
+		return
+	}
+	ratio := float64(actual) / float64(estimate)
+
+	tokenCalibration.Lock()
+	defer tokenCalibration.Unlock()
+	if factor, ok := tokenCalibration.factors[model]; ok {
+		ratio = factor*(1-calibrationWeight) + ratio*calibrationWeight
+	}
+	tokenCalibration.factors[model] = ratio
+	tokenCalibration.dirty = true
+}
+
+// loadTokenCalibration reads the factors saved in dir and saves them there
+// from then on.
+func loadTokenCalibration(dir string) error {
+	path := filepath.Join(dir, tokenCalibrationFile)
+
+	tokenCalibration.Lock()
+	defer tokenCalibration.Unlock()
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &tokenCalibration.factors); err != nil {
+			printWarning(context.Background(), "Discarding token count calibration %s: %v\n", path, err)
+			tokenCalibration.factors = make(map[anthropic.Model]float64)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tokenCalibration.path = path
+	return nil
+}
+
+// saveTokenCalibrationPeriodically saves the factors whenever they changed.
+// It never returns.
+func saveTokenCalibrationPeriodically() {
+	for {
+		time.Sleep(tokenCalibrationSaveInterval)
+		flushTokenCalibration()
+	}
+}
+
+// Serializes the writes of flushTokenCalibration, which happen outside the
+// tokenCalibration lock so count_tokens requests never wait for the disk.
+var tokenCalibrationSave sync.Mutex
+
+// flushTokenCalibration saves the factors if they changed since they were
+// last saved.
+func flushTokenCalibration() {
+	tokenCalibrationSave.Lock()
+	defer tokenCalibrationSave.Unlock()
+
+	tokenCalibration.Lock()
+	path, dirty := tokenCalibration.path, tokenCalibration.dirty
+	factors := maps.Clone(tokenCalibration.factors)
+	tokenCalibration.dirty = false
+	tokenCalibration.Unlock()
+
+	if path == "" || !dirty {
+		return
+	}
+	if err := saveTokenCalibration(path, factors); err != nil {
+		printRed(context.Background(), "Error saving token count calibration to %s: %v\n", path, err)
+	}
+}
+
+// saveTokenCalibration replaces the file at path in one step, so a crash
+// never leaves it half written.
+func saveTokenCalibration(path string, factors map[anthropic.Model]float64) error {
+	data, err := json.MarshalIndent(factors, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func calibratedTokens(model anthropic.Model, estimate int) int {
+	tokenCalibration.Lock()
+	factor, ok := tokenCalibration.factors[model]
+	tokenCalibration.Unlock()
+	if !ok {
+		return estimate
+	}
+	return int(float64(estimate)*factor + 0.5)
+}
+
+// tokenEstimate travels with a forwarded count_tokens request so the
+// response side can calibrate against the real count or stand in for it.
+type tokenEstimate struct {
+	model anthropic.Model
+	raw   int
+	// Whether the estimate may stand in for a failed upstream answer.
+	fallback bool
+	// Set when the upstream answer was replaced by the estimate.
+	local bool
+}
+
+func (e *tokenEstimate) body() []byte {
+	return fmt.Appendf(nil, `{"input_tokens":%d}`, calibratedTokens(e.model, e.raw))
+}
+
+const tokenEstimateKey contextKey = "token_estimate"
+
+func addTokenEstimateToContext(ctx context.Context, estimate *tokenEstimate) context.Context {
+	return context.WithValue(ctx, tokenEstimateKey, estimate)
+}
+
+func getTokenEstimateFromContext(ctx context.Context) (*tokenEstimate, bool) {
+	estimate, ok := ctx.Value(tokenEstimateKey).(*tokenEstimate)
+	return estimate, ok
+}
+
+// answerTokenCountLocally replaces a rate limited or overloaded count_tokens
+// response with the local estimate in fallback mode.
+func answerTokenCountLocally(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != 529 {
+		return nil
+	}
+	estimate, ok := getTokenEstimateFromContext(resp.Request.Context())
+	if !ok || !estimate.fallback {
+		return nil
+	}
+
+	printYellow(resp.Request.Context(), "Token count upstream returned %d, answering with local estimate\n", resp.StatusCode)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	body := estimate.body()
+	estimate.local = true
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.Header = http.Header{"Content-Type": {"application/json"}}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// learnFromTokenCount calibrates the local estimate against the count the API
+// just returned for the same request. Cached counts are not learned from
+// again, or the most repeated requests would dominate the average.
+func learnFromTokenCount(estimate *tokenEstimate, body []byte) {
+	var response struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if json.Unmarshal(body, &response) != nil {
+		return
+	}
+	calibrateTokens(estimate.model, estimate.raw, response.InputTokens)
+}
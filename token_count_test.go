@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestTokenCalibrationFlush(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, tokenCalibrationFile)
+	if err := loadTokenCalibration(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tokenCalibration.Lock()
+		tokenCalibration.path = ""
+		tokenCalibration.Unlock()
+	})
+	model := anthropic.Model("claude-test-calibration")
+
+	calibrateTokens(model, 100, 120)
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("calibration written before a flush")
+	}
+
+	flushTokenCalibration()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var factors map[anthropic.Model]float64
+	if err := json.Unmarshal(data, &factors); err != nil {
+		t.Fatal(err)
+	}
+	if factors[model] != 1.2 {
+		t.Errorf("saved factor %v, want 1.2", factors[model])
+	}
+
+	// Nothing changed, so nothing is written.
+	os.Remove(path)
+	flushTokenCalibration()
+	if _, err := os.Stat(path); err == nil {
+		t.Error("unchanged calibration written again")
+	}
+}
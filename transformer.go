@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Transformer rewrites a parsed /v1/messages or /v1/messages/count_tokens
+// request before it is forwarded upstream. Register new ones with
+// registerTransformer from an init function; handleMessage and
+// handleTokenCount run every registered transformer in order.
+type Transformer interface {
+	// Name identifies the transformer in logs and is the key of its entry
+	// under transforms in the config file.
+	Name() string
+	// Order positions the transformer in the pipeline. Lower runs first.
+	Order() int
+	// Applies reports whether the transformer handles requests for the given
+	// model and path. This is checked in addition to the config's enabled
+	// flag and model.
+	Applies(model anthropic.Model, path string) bool
+	// Transform modifies the request in place and reports whether anything
+	// changed.
+	Transform(tc *transformContext) bool
+}
+
+// transformContext is what a Transformer gets to work with for one request.
+type transformContext struct {
+	params *anthropic.BetaMessageNewParams
+	state  *runtimeState
+	// The incoming request. Transformers may add headers to it; the body is
+	// replaced with the marshaled params afterwards.
+	request *http.Request
+	// Transformer settings resolved for the request's model.
+	transforms TransformsConfig
+
+	notes []string
+}
+
+// notef records a short description of a change, logged against the name of
+// the transformer that made it.
+func (tc *transformContext) notef(format string, args ...any) {
+	tc.notes = append(tc.notes, fmt.Sprintf(format, args...))
+}
+
+var transformers []Transformer
+
+func registerTransformer(t Transformer) {
+	transformers = append(transformers, t)
+	sort.SliceStable(transformers, func(i, j int) bool {
+		return transformers[i].Order() < transformers[j].Order()
+	})
+}
+
+func isRegisteredTransformer(name string) bool {
+	return slices.ContainsFunc(transformers, func(t Transformer) bool { return t.Name() == name })
+}
+
+// runTransformers passes the request through every enabled transformer and
+// reports whether any of them modified it.
+func runTransformers(tc *transformContext) bool {
+	model := tc.params.Model
+	tc.transforms = tc.state.config.transformsFor(model)
+
+	var modified bool
+	for _, t := range transformers {
+		if !tc.transforms.lookup(t.Name()).applies(model) || !t.Applies(model, tc.request.URL.Path) {
+			continue
+		}
+
+		tc.notes = nil
+		if !t.Transform(tc) {
+			continue
+		}
+		modified = true
+
+		if len(tc.notes) == 0 {
+			tc.notef("modified request")
+		}
+		for _, note := range tc.notes {
+			logAttrs(tc.request.Context(), slog.LevelInfo, colorYellow, note, slog.String("transformer", t.Name()))
+		}
+	}
+	return modified
+}
+
+// funcTransformer adapts a plain function to the Transformer interface. All
+// the built-in transformers are defined this way.
+type funcTransformer struct {
+	name  string
+	order int
+	paths []string
+	fn    func(tc *transformContext) bool
+}
+
+func (f funcTransformer) Name() string { return f.name }
+
+func (f funcTransformer) Order() int { return f.order }
+
+func (f funcTransformer) Applies(_ anthropic.Model, path string) bool {
+	return slices.Contains(f.paths, path)
+}
+
+func (f funcTransformer) Transform(tc *transformContext) bool { return f.fn(tc) }
+
+func init() {
+	messagesPath := []string{"/v1/messages"}
+	// Transformers that change the input size also run on count_tokens so
+	// the counts match what is actually sent.
+	bothPaths := []string{"/v1/messages", "/v1/messages/count_tokens"}
+
+	registerTransformer(funcTransformer{name: "temperature", order: 100, paths: messagesPath, fn: setTemperature})
+	registerTransformer(funcTransformer{name: "user_prompt", order: 200, paths: bothPaths, fn: setUserPrompt})
+	registerTransformer(funcTransformer{name: "system_prompt", order: 300, paths: bothPaths, fn: setSystemPrompt})
+	registerTransformer(funcTransformer{name: "tools", order: 400, paths: bothPaths, fn: filterTools})
+	// Cache breakpoints depend on the final shape of the request, so this
+	// must run last.
+	registerTransformer(funcTransformer{name: "cache_control", order: 1000, paths: messagesPath, fn: alterCacheControl})
+}
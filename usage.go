@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// usage mirrors the token counts reported in message_start, message_delta
+// and non-streaming message bodies.
+type usage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+	// Split of the cache writes by TTL, which are billed differently.
+	CacheCreation cacheCreation `json:"cache_creation"`
+}
+
+type cacheCreation struct {
+	Ephemeral5mInputTokens int64 `json:"ephemeral_5m_input_tokens"`
+	Ephemeral1hInputTokens int64 `json:"ephemeral_1h_input_tokens"`
+}
+
+// merge overlays the non-zero counts of u2. message_delta carries cumulative
+// counts, so a later value replaces an earlier one rather than adding to it.
+func (u *usage) merge(u2 usage) {
+	if u2.InputTokens != 0 {
+		u.InputTokens = u2.InputTokens
+	}
+	if u2.OutputTokens != 0 {
+		u.OutputTokens = u2.OutputTokens
+	}
+	if u2.CacheCreationInputTokens != 0 {
+		u.CacheCreationInputTokens = u2.CacheCreationInputTokens
+	}
+	if u2.CacheReadInputTokens != 0 {
+		u.CacheReadInputTokens = u2.CacheReadInputTokens
+	}
+	if u2.CacheCreation.Ephemeral5mInputTokens != 0 {
+		u.CacheCreation.Ephemeral5mInputTokens = u2.CacheCreation.Ephemeral5mInputTokens
+	}
+	if u2.CacheCreation.Ephemeral1hInputTokens != 0 {
+		u.CacheCreation.Ephemeral1hInputTokens = u2.CacheCreation.Ephemeral1hInputTokens
+	}
+}
+
+func (u *usage) add(u2 usage) {
+	u.InputTokens += u2.InputTokens
+	u.OutputTokens += u2.OutputTokens
+	u.CacheCreationInputTokens += u2.CacheCreationInputTokens
+	u.CacheReadInputTokens += u2.CacheReadInputTokens
+	u.CacheCreation.Ephemeral5mInputTokens += u2.CacheCreation.Ephemeral5mInputTokens
+	u.CacheCreation.Ephemeral1hInputTokens += u2.CacheCreation.Ephemeral1hInputTokens
+}
+
+// ModelPrice is the price of a model in USD per million tokens.
+type ModelPrice struct {
+	Models     []string `yaml:"models"`
+	Input      float64  `yaml:"input"`
+	Output     float64  `yaml:"output"`
+	CacheWrite float64  `yaml:"cache_write"`
+	// Price of cache writes with the 1 hour TTL. 0 means twice the input
+	// price, which is what the API charges.
+	CacheWrite1h float64 `yaml:"cache_write_1h"`
+	CacheRead    float64 `yaml:"cache_read"`
+}
+
+// defaultPrices is consulted after the prices in the config file.
+var defaultPrices = []ModelPrice{
+	{Models: []string{"claude-opus-4*", "claude-3-opus*"}, Input: 15, Output: 75, CacheWrite: 18.75, CacheWrite1h: 30, CacheRead: 1.50},
+	{Models: []string{"claude-sonnet-4*", "claude-3-7-sonnet*", "claude-3-5-sonnet*"}, Input: 3, Output: 15, CacheWrite: 3.75, CacheWrite1h: 6, CacheRead: 0.30},
+	{Models: []string{"claude-3-5-haiku*"}, Input: 0.80, Output: 4, CacheWrite: 1, CacheWrite1h: 1.6, CacheRead: 0.08},
+	{Models: []string{"claude-3-haiku*"}, Input: 0.25, Output: 1.25, CacheWrite: 0.30, CacheWrite1h: 0.50, CacheRead: 0.03},
+}
+
+func (c Config) priceFor(model anthropic.Model) (ModelPrice, bool) {
+	for _, prices := range [][]ModelPrice{c.Prices, defaultPrices} {
+		for _, price := range prices {
+			if matchModel(price.Models, model) {
+				return price, true
+			}
+		}
+	}
+	return ModelPrice{}, false
+}
+
+func (p ModelPrice) cost(u usage) float64 {
+	return (float64(u.InputTokens)*p.Input +
+		float64(u.OutputTokens)*p.Output +
+		p.cacheWriteCost(u) +
+		float64(u.CacheReadInputTokens)*p.CacheRead) / 1e6
+}
+
+// cacheWriteCost prices the cache writes in u, in USD times a million.
+// Writes with the 1 hour TTL have their own rate; the rest are 5 minute
+// writes.
+func (p ModelPrice) cacheWriteCost(u usage) float64 {
+	oneHour := min(u.CacheCreation.Ephemeral1hInputTokens, u.CacheCreationInputTokens)
+	rate1h := p.CacheWrite1h
+	if rate1h == 0 {
+		rate1h = 2 * p.Input
+	}
+	return float64(u.CacheCreationInputTokens-oneHour)*p.CacheWrite + float64(oneHour)*rate1h
+}
+
+// requestInfo collects what is learned about a request while it is being
+// proxied, for reporting once the response is done.
+type requestInfo struct {
+	// Short random ID to tell the log lines of concurrent requests apart.
+	id    string
+	path  string
+	start time.Time
+	// Claude Code session the request belongs to, if known.
+	session string
+
+	mu       sync.Mutex
+	model    anthropic.Model
+	usage    usage
+	hasUsage bool
+}
+
+const requestInfoKey contextKey = "request_info"
+
+func newRequestInfo(r *http.Request) *requestInfo {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return &requestInfo{id: hex.EncodeToString(id), path: r.URL.Path, start: time.Now()}
+}
+
+func addRequestInfoToContext(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+func getRequestInfoFromContext(ctx context.Context) (*requestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey).(*requestInfo)
+	return info, ok
+}
+
+// usageTransformer records the model and token usage reported by the API.
+type usageTransformer struct{}
+
+func (usageTransformer) Name() string { return "usage" }
+
+func (usageTransformer) Order() int { return 10 }
+
+func (usageTransformer) Applies(rc *responseContext) bool {
+	_, ok := getRequestInfoFromContext(rc.request.Context())
+	return ok
+}
+
+func (usageTransformer) TransformEvent(rc *responseContext, ev *sseEvent) bool {
+	if ev.Event != "message_start" && ev.Event != "message_delta" && ev.Event != "message" {
+		return true
+	}
+
+	var payload struct {
+		Model   anthropic.Model `json:"model"`
+		Usage   *usage          `json:"usage"`
+		Message struct {
+			Model anthropic.Model `json:"model"`
+			Usage *usage          `json:"usage"`
+		} `json:"message"`
+	}
+	if err := ev.decode(&payload); err != nil {
+		printRed(rc.request.Context(), "Error decoding usage from %s event: %v\n", ev.Event, err)
+		return true
+	}
+
+	model, reported := payload.Model, payload.Usage
+	if ev.Event == "message_start" {
+		model, reported = payload.Message.Model, payload.Message.Usage
+	}
+
+	info, _ := getRequestInfoFromContext(rc.request.Context())
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if model != "" {
+		info.model = model
+	}
+	if reported != nil {
+		info.usage.merge(*reported)
+		info.hasUsage = true
+	}
+	return true
+}
+
+func init() {
+	registerResponseTransformer(usageTransformer{})
+}
+
+// sessionUsage accumulates usage and cost over the lifetime of the proxy.
+var sessionUsage struct {
+	sync.Mutex
+	requests int
+	usage    usage
+	cost     float64
+}
+
+// logUsage prints the usage and cost of a finished request together with the
+// running totals for the session.
+func logUsage(ctx context.Context, info *requestInfo, config Config) {
+	info.mu.Lock()
+	model, u, ok := info.model, info.usage, info.hasUsage
+	info.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	price, priced := config.priceFor(model)
+	cost := price.cost(u)
+
+	sessionUsage.Lock()
+	sessionUsage.requests++
+	sessionUsage.usage.add(u)
+	sessionUsage.cost += cost
+	requests, total := sessionUsage.requests, sessionUsage.cost
+	sessionUsage.Unlock()
+
+	var hit float64
+	if input := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens; input > 0 {
+		hit = 100 * float64(u.CacheReadInputTokens) / float64(input)
+	}
+	attrs := []slog.Attr{
+		slog.Int64("input_tokens", u.InputTokens),
+		slog.Int64("output_tokens", u.OutputTokens),
+		slog.Int64("cache_write_tokens", u.CacheCreationInputTokens),
+		slog.Int64("cache_read_tokens", u.CacheReadInputTokens),
+		slog.String("cache_hit", fmt.Sprintf("%.1f%%", hit)),
+	}
+	if priced {
+		recordCacheStats(model, info.session, u, price)
+		attrs = append(attrs, slog.String("cost_usd", fmt.Sprintf("%.4f", cost)))
+	}
+	attrs = append(attrs,
+		slog.Int("session_requests", requests),
+		slog.String("session_cost_usd", fmt.Sprintf("%.4f", total)))
+	logAttrs(ctx, slog.LevelInfo, colorBlue, "usage", attrs...)
+}